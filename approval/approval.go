@@ -0,0 +1,238 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package approval
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Approvals of a Service's exposure, signed by whoever may grant them, e.g.
+// the security team, so that the people deploying a Service can't approve it
+// themselves.
+//
+// A token is "<key id>.<claims>.<signature>", each part base64url encoded
+// without padding. The claims are JSON, and the signature is over
+// "<key id>.<claims>", with HMAC-SHA256 or Ed25519 as the key with that id
+// is configured.
+
+type Claims struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// The ports that may be exposed, as "443/TCP"
+	Ports   []string `json:"ports"`
+	Expires int64    `json:"expires"`
+}
+
+// A key approvals are verified with. Exactly one of HMACSecret and PublicKey
+// is set.
+type Key struct {
+	HMACSecret []byte
+	PublicKey  ed25519.PublicKey
+}
+
+// The keys approvals are verified with, by id
+type Keys map[string]Key
+
+// A key approvals are signed with. Exactly one of HMACSecret and PrivateKey
+// is set.
+type SigningKey struct {
+	ID         string
+	HMACSecret []byte
+	PrivateKey ed25519.PrivateKey
+}
+
+// Where the key with the id is read from
+type KeyOptions struct {
+	ID string `yaml:"id" json:"id"`
+	// A file containing the shared secret
+	HMACSecretFile string `yaml:"hmacSecretFile" json:"hmacSecretFile,omitempty"`
+	// A file containing the base64 encoded public key
+	Ed25519PublicKeyFile string `yaml:"ed25519PublicKeyFile" json:"ed25519PublicKeyFile,omitempty"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// Normalise a port and protocol as they're written in claims
+func Port(port int32, protocol string) string {
+	if protocol == "" {
+		protocol = "TCP"
+	}
+	return fmt.Sprintf("%d/%s", port, strings.ToUpper(protocol))
+}
+
+// Read the keys from their files
+func LoadKeys(options []KeyOptions) (Keys, error) {
+	keys := Keys{}
+	for i, o := range options {
+		if o.ID == "" || strings.Contains(o.ID, ".") {
+			return nil, fmt.Errorf("keys[%d]: invalid id '%s'", i, o.ID)
+		}
+		if _, found := keys[o.ID]; found {
+			return nil, fmt.Errorf("keys[%d]: duplicate id '%s'", i, o.ID)
+		}
+		if (o.HMACSecretFile == "") == (o.Ed25519PublicKeyFile == "") {
+			return nil, fmt.Errorf("keys[%d]: exactly one of hmacSecretFile and ed25519PublicKeyFile is required", i)
+		}
+
+		var key Key
+		var err error
+		if o.HMACSecretFile != "" {
+			key.HMACSecret, err = readSecret(o.HMACSecretFile)
+		} else {
+			var public []byte
+			if public, err = readBase64(o.Ed25519PublicKeyFile); err == nil && len(public) != ed25519.PublicKeySize {
+				err = fmt.Errorf("%s is not an Ed25519 public key", o.Ed25519PublicKeyFile)
+			}
+			key.PublicKey = public
+		}
+		if err != nil {
+			return nil, fmt.Errorf("keys[%d]: %v", i, err)
+		}
+		keys[o.ID] = key
+	}
+	return keys, nil
+}
+
+// Read a signing key from its file, either an HMAC secret or a base64
+// encoded Ed25519 private key
+func LoadSigningKey(id, hmacSecretFile, ed25519PrivateKeyFile string) (*SigningKey, error) {
+	if (hmacSecretFile == "") == (ed25519PrivateKeyFile == "") {
+		return nil, fmt.Errorf("exactly one of an HMAC secret and an Ed25519 private key is required")
+	}
+
+	key := &SigningKey{ID: id}
+	if hmacSecretFile != "" {
+		secret, err := readSecret(hmacSecretFile)
+		key.HMACSecret = secret
+		return key, err
+	}
+	private, err := readBase64(ed25519PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	switch len(private) {
+	case ed25519.SeedSize:
+		key.PrivateKey = ed25519.NewKeyFromSeed(private)
+	case ed25519.PrivateKeySize:
+		key.PrivateKey = private
+	default:
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", ed25519PrivateKeyFile)
+	}
+	return key, nil
+}
+
+func readSecret(file string) ([]byte, error) {
+	secret, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("the secret in %s is too short, expecting at least 16 bytes", file)
+	}
+	return secret, nil
+}
+
+func readBase64(file string) ([]byte, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not base64 encoded: %v", file, err)
+	}
+	return decoded, nil
+}
+
+// Sign the claims, returning the token
+func (k *SigningKey) Sign(claims Claims) (string, error) {
+	if k.ID == "" || strings.Contains(k.ID, ".") {
+		return "", fmt.Errorf("invalid key id '%s'", k.ID)
+	}
+	ports := append([]string{}, claims.Ports...)
+	sort.Strings(ports)
+	claims.Ports = ports
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := k.ID + "." + encoding.EncodeToString(payload)
+
+	var signature []byte
+	if k.PrivateKey != nil {
+		signature = ed25519.Sign(k.PrivateKey, []byte(signed))
+	} else {
+		signature = hmacSHA256(k.HMACSecret, signed)
+	}
+	return signed + "." + encoding.EncodeToString(signature), nil
+}
+
+func hmacSHA256(secret []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// Verify the token's signature and expiry, returning its claims
+func (k Keys) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed approval token")
+	}
+	key, found := k[parts[0]]
+	if !found {
+		return nil, fmt.Errorf("approval signed with unknown key '%s'", parts[0])
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed approval signature")
+	}
+
+	signed := parts[0] + "." + parts[1]
+	var valid bool
+	if key.PublicKey != nil {
+		valid = ed25519.Verify(key.PublicKey, []byte(signed), signature)
+	} else {
+		valid = hmac.Equal(hmacSHA256(key.HMACSecret, signed), signature)
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid approval signature")
+	}
+
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed approval claims")
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed approval claims: %v", err)
+	}
+	if now.Unix() >= claims.Expires {
+		return nil, fmt.Errorf("approval expired at %s", time.Unix(claims.Expires, 0).UTC().Format(time.RFC3339))
+	}
+	return &claims, nil
+}
@@ -0,0 +1,126 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package approval
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2018, 4, 21, 3, 19, 46, 0, time.UTC)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSignAndVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "approval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretFile := writeFile(t, dir, "secret", "a-shared-secret-of-some-length\n")
+	privateFile := writeFile(t, dir, "private", base64.StdEncoding.EncodeToString(private.Seed()))
+	publicFile := writeFile(t, dir, "public", base64.StdEncoding.EncodeToString(public))
+
+	keys, err := LoadKeys([]KeyOptions{
+		{ID: "shared", HMACSecretFile: secretFile},
+		{ID: "security", Ed25519PublicKeyFile: publicFile},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := Claims{Namespace: "default", Name: "web", Ports: []string{"443/TCP", "80/TCP"}, Expires: now.Add(time.Hour).Unix()}
+	for _, signing := range [][2]string{{"shared", secretFile}, {"security", ""}} {
+		var key *SigningKey
+		if signing[1] != "" {
+			key, err = LoadSigningKey(signing[0], signing[1], "")
+		} else {
+			key, err = LoadSigningKey(signing[0], "", privateFile)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := key.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verified, err := keys.Verify(token, now)
+		if err != nil {
+			t.Fatalf("%s: expecting the token to verify, got %v", signing[0], err)
+		}
+		if verified.Name != "web" || verified.Namespace != "default" || len(verified.Ports) != 2 || verified.Ports[0] != "443/TCP" {
+			t.Errorf("%s: unexpected claims %+v", signing[0], verified)
+		}
+
+		if _, err := keys.Verify(token, now.Add(time.Hour)); err == nil || !strings.Contains(err.Error(), "expired") {
+			t.Errorf("%s: expecting the token to have expired, got %v", signing[0], err)
+		}
+
+		// changing the claims invalidates the signature
+		parts := strings.Split(token, ".")
+		parts[1] = encoding.EncodeToString([]byte(`{"namespace":"default","name":"web","ports":["22/TCP"],"expires":9999999999}`))
+		if _, err := keys.Verify(strings.Join(parts, "."), now); err == nil {
+			t.Errorf("%s: expecting a tampered token to be refused", signing[0])
+		}
+	}
+
+	for _, token := range []string{"", "External", "unknown.e30.e30", "shared.e30.!"} {
+		if _, err := keys.Verify(token, now); err == nil {
+			t.Errorf("Expecting token '%s' to be refused", token)
+		}
+	}
+}
+
+func TestLoadKeysErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "approval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := writeFile(t, dir, "secret", "a-shared-secret-of-some-length")
+	shortFile := writeFile(t, dir, "short", "short")
+
+	for _, options := range [][]KeyOptions{
+		{{ID: "", HMACSecretFile: secretFile}},
+		{{ID: "a.b", HMACSecretFile: secretFile}},
+		{{ID: "a"}},
+		{{ID: "a", HMACSecretFile: secretFile, Ed25519PublicKeyFile: secretFile}},
+		{{ID: "a", HMACSecretFile: shortFile}},
+		{{ID: "a", Ed25519PublicKeyFile: secretFile}},
+		{{ID: "a", HMACSecretFile: secretFile}, {ID: "a", HMACSecretFile: secretFile}},
+	} {
+		if _, err := LoadKeys(options); err == nil {
+			t.Errorf("Expecting keys %+v to be refused", options)
+		}
+	}
+}
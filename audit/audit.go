@@ -0,0 +1,189 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/benburry/k8s-admission-webhooks/handlers"
+)
+
+// A durable record of every admission decision, written as one JSON object
+// per line to a file that is rotated by size.
+
+type Level string
+
+const (
+	// Who requested what, and the decision made
+	LevelMetadata Level = "metadata"
+	// As LevelMetadata, plus the rejection message, violations and warnings
+	LevelViolations Level = "violations"
+	// As LevelViolations, plus the objects under review. These may contain
+	// sensitive data, such as the contents of Secrets.
+	LevelRequest Level = "request"
+)
+
+// An empty level is valid, and treated as LevelViolations
+func (l Level) Valid() bool {
+	switch l {
+	case "", LevelMetadata, LevelViolations, LevelRequest:
+		return true
+	}
+	return false
+}
+
+type Options struct {
+	// The file to write to. Rotated files are kept alongside it.
+	Path string `yaml:"path"`
+	// Defaults to LevelViolations
+	Level Level `yaml:"level"`
+	// Rotate the file once it reaches this size. Defaults to 100MB.
+	MaxSizeMB int `yaml:"maxSizeMB"`
+	// How many rotated files to keep. 0 keeps every file.
+	MaxBackups int `yaml:"maxBackups"`
+	// Remove rotated files older than this many days. 0 keeps every file.
+	MaxAgeDays int `yaml:"maxAgeDays"`
+}
+
+func (o *Options) Validate() error {
+	if o.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if !o.Level.Valid() {
+		return fmt.Errorf("level must be one of '%s', '%s' or '%s', not '%s'", LevelMetadata, LevelViolations, LevelRequest, o.Level)
+	}
+	if o.MaxSizeMB < 0 || o.MaxBackups < 0 || o.MaxAgeDays < 0 {
+		return fmt.Errorf("maxSizeMB, maxBackups and maxAgeDays must not be negative")
+	}
+	return nil
+}
+
+func (o *Options) level() Level {
+	if o.Level == "" {
+		return LevelViolations
+	}
+	return o.Level
+}
+
+// A single line of the audit log
+type Entry struct {
+	Timestamp   time.Time                   `json:"timestamp"`
+	UID         types.UID                   `json:"uid"`
+	Handler     string                      `json:"handler"`
+	Resource    metav1.GroupVersionResource `json:"resource"`
+	SubResource string                      `json:"subResource,omitempty"`
+	Namespace   string                      `json:"namespace,omitempty"`
+	Name        string                      `json:"name,omitempty"`
+	Operation   v1beta1.Operation           `json:"operation"`
+	Username    string                      `json:"username"`
+	Groups      []string                    `json:"groups,omitempty"`
+	Enforcement handlers.EnforcementMode    `json:"enforcement"`
+	Decision    handlers.DecisionOutcome    `json:"decision"`
+	Allowed     bool                        `json:"allowed"`
+	LatencyMS   float64                     `json:"latencyMs"`
+
+	Message    string              `json:"message,omitempty"`
+	Violations handlers.Violations `json:"violations,omitempty"`
+	Warnings   []string            `json:"warnings,omitempty"`
+
+	Object    json.RawMessage `json:"object,omitempty"`
+	OldObject json.RawMessage `json:"oldObject,omitempty"`
+}
+
+type Logger struct {
+	level Level
+
+	lock   sync.Mutex
+	writer *rotatingFile
+}
+
+func NewLogger(options Options) (*Logger, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	maxSize := int64(options.MaxSizeMB) * 1024 * 1024
+	if maxSize == 0 {
+		maxSize = 100 * 1024 * 1024
+	}
+
+	writer, err := openRotatingFile(options.Path, maxSize, options.MaxBackups, time.Duration(options.MaxAgeDays)*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{level: options.level(), writer: writer}, nil
+}
+
+func (l *Logger) Record(decision *handlers.Decision) {
+	line, err := json.Marshal(NewEntry(decision, l.level))
+	if err != nil {
+		glog.Errorf("Unable to write audit log entry for %s: %v", decision.UID, err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.writer.Write(line); err != nil {
+		glog.Errorf("Unable to write audit log entry for %s: %v", decision.UID, err)
+	}
+}
+
+func (l *Logger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.writer.Close()
+}
+
+// The record of a decision, with the detail given by level
+func NewEntry(decision *handlers.Decision, level Level) *Entry {
+	entry := &Entry{
+		Timestamp:   decision.Time.UTC(),
+		UID:         decision.UID,
+		Handler:     decision.Handler,
+		Resource:    decision.Resource,
+		SubResource: decision.SubResource,
+		Namespace:   decision.Namespace,
+		Name:        decision.Name,
+		Operation:   decision.Operation,
+		Username:    decision.User,
+		Groups:      decision.Groups,
+		Enforcement: decision.Enforcement,
+		Decision:    decision.Outcome,
+		Allowed:     decision.Allowed,
+		LatencyMS:   float64(decision.Latency) / float64(time.Millisecond),
+	}
+
+	if level == LevelMetadata {
+		return entry
+	}
+	entry.Message = decision.Message
+	entry.Violations = decision.Violations
+	entry.Warnings = decision.Warnings
+
+	if level == LevelRequest {
+		entry.Object = decision.Object
+		entry.OldObject = decision.OldObject
+	}
+	return entry
+}
@@ -0,0 +1,120 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benburry/k8s-admission-webhooks/handlers"
+)
+
+func testDecision() *handlers.Decision {
+	return &handlers.Decision{
+		Time:        time.Date(2018, 4, 21, 3, 19, 46, 0, time.UTC),
+		UID:         "d7e11614-4512-11e8-8d4f-b827ebf9752a",
+		Handler:     "gkepublicservice",
+		Kind:        "Service",
+		Namespace:   "default",
+		Name:        "test-service",
+		Operation:   "CREATE",
+		User:        "kubernetes-admin",
+		Groups:      []string{"system:masters"},
+		Enforcement: handlers.EnforcementEnforce,
+		Outcome:     handlers.OutcomeDenied,
+		Message:     "The service 'test-service' is public",
+		Violations:  handlers.Violations{{Field: "metadata.annotations", RuleID: "gkepublicservice.opt-in", Message: "The service 'test-service' is public"}},
+		Latency:     1500 * time.Microsecond,
+		Object:      json.RawMessage(`{"metadata":{"name":"test-service"}}`),
+	}
+}
+
+func readEntries(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Expecting a JSON object per line: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLevels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		level      Level
+		violations bool
+		object     bool
+	}{
+		{LevelMetadata, false, false},
+		{"", true, false},
+		{LevelViolations, true, false},
+		{LevelRequest, true, true},
+	}
+
+	for i, test := range tests {
+		path := filepath.Join(dir, string(rune('a'+i))+".log")
+		logger, err := NewLogger(Options{Path: path, Level: test.level})
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.Record(testDecision())
+		logger.Close()
+
+		entries := readEntries(t, path)
+		if len(entries) != 1 {
+			t.Fatalf("Expecting one entry, got %d", len(entries))
+		}
+		entry := entries[0]
+
+		if entry["uid"] != "d7e11614-4512-11e8-8d4f-b827ebf9752a" || entry["handler"] != "gkepublicservice" || entry["decision"] != "denied" ||
+			entry["username"] != "kubernetes-admin" || entry["latencyMs"] != 1.5 || entry["timestamp"] != "2018-04-21T03:19:46Z" {
+			t.Errorf("Unexpected entry at level %s: %v", test.level, entry)
+		}
+		if _, found := entry["violations"]; found != test.violations {
+			t.Errorf("Expecting violations at level '%s' to be %v", test.level, test.violations)
+		}
+		if _, found := entry["object"]; found != test.object {
+			t.Errorf("Expecting object at level '%s' to be %v", test.level, test.object)
+		}
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []Options{{}, {Path: "audit.log", Level: "everything"}, {Path: "audit.log", MaxBackups: -1}} {
+		if _, err := NewLogger(options); err == nil {
+			t.Errorf("Expecting options %+v to be refused", options)
+		}
+	}
+}
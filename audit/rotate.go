@@ -0,0 +1,166 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// A file that is renamed with a timestamp suffix, and replaced, once it
+// reaches its maximum size. Not safe for concurrent use.
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+
+	file *os.File
+	size int64
+	// overridden in tests
+	now func() time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, maxAge: maxAge, now: time.Now}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		// if rotating fails, writing continues and it's retried on the next write
+		if err := r.rotate(); err != nil {
+			glog.Errorf("Unable to rotate audit log %s: %v", r.path, err)
+		}
+	}
+	if r.file == nil {
+		// reopening the file after rotating it failed
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+func (r *rotatingFile) rotate() error {
+	// rename the file while it's still open, so that it can still be written
+	// to if the rename fails
+	backup := r.backupPath(r.now())
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+
+	if err := r.file.Close(); err != nil {
+		glog.Errorf("Unable to close audit log %s: %v", backup, err)
+	}
+	if err := r.open(); err != nil {
+		// reopened by the next write
+		r.file, r.size = nil, 0
+		return err
+	}
+
+	r.removeOldBackups()
+	return nil
+}
+
+// the name of the backup rotated at the given time
+func (r *rotatingFile) backupPath(t time.Time) string {
+	ext := filepath.Ext(r.path)
+	return strings.TrimSuffix(r.path, ext) + "-" + t.UTC().Format(backupTimeFormat) + ext
+}
+
+// when the backup was rotated, and whether the file is one of the backups at
+// all, rather than another file with the same prefix
+func (r *rotatingFile) backupTime(backup string) (time.Time, bool) {
+	ext := filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(r.path, ext) + "-"
+	if !strings.HasPrefix(backup, prefix) || !strings.HasSuffix(backup, ext) {
+		return time.Time{}, false
+	}
+	timestamp, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(backup, prefix), ext))
+	return timestamp, err == nil
+}
+
+// the rotated files, newest first
+func (r *rotatingFile) backups() []string {
+	ext := filepath.Ext(r.path)
+	matches, err := filepath.Glob(strings.TrimSuffix(r.path, ext) + "-*" + ext)
+	if err != nil {
+		return nil
+	}
+	var backups []string
+	for _, match := range matches {
+		if _, ok := r.backupTime(match); ok {
+			backups = append(backups, match)
+		}
+	}
+	// the timestamp format sorts lexically
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups
+}
+
+func (r *rotatingFile) removeOldBackups() {
+	for i, backup := range r.backups() {
+		timestamp, _ := r.backupTime(backup)
+		expired := r.maxAge > 0 && r.now().Sub(timestamp) > r.maxAge
+
+		if (r.maxBackups > 0 && i >= r.maxBackups) || expired {
+			if err := os.Remove(backup); err != nil {
+				glog.Errorf("Unable to remove old audit log %s: %v", backup, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	r, err := openRotatingFile(path, 10, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	now := time.Date(2018, 4, 21, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	current, _ := ioutil.ReadFile(path)
+	if string(current) != "fourth\n" {
+		t.Errorf("Expecting the current file to hold the last write, got %q", current)
+	}
+
+	backups := r.backups()
+	if len(backups) != 2 {
+		t.Fatalf("Expecting only 2 backups to be kept, got %v", backups)
+	}
+	newest, _ := ioutil.ReadFile(backups[0])
+	if string(newest) != "third\n" || !strings.HasSuffix(backups[0], "-2018-04-21T00-00-03.000.log") {
+		t.Errorf("Unexpected newest backup %s: %q", backups[0], newest)
+	}
+}
+
+func TestRetentionByAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	old := filepath.Join(dir, "audit-2018-01-01T00-00-00.000.log")
+	if err := ioutil.WriteFile(old, []byte("old\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openRotatingFile(path, 5, 0, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.now = func() time.Time { return time.Date(2018, 4, 21, 0, 0, 0, 0, time.UTC) }
+
+	r.Write([]byte("first\n"))
+	r.Write([]byte("second\n"))
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("Expecting backups older than the maximum age to be removed")
+	}
+	if backups := r.backups(); len(backups) != 1 {
+		t.Errorf("Expecting the new backup to be kept, got %v", backups)
+	}
+}
+
+func TestRotationFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	r, err := openRotatingFile(path, 10, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	now := time.Date(2018, 4, 21, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	// a directory in the backup's place makes the rename fail
+	blocked := filepath.Join(dir, "audit-2018-04-21T00-00-00.000.log", "x")
+	if err := os.MkdirAll(blocked, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"first\n", "second\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatalf("Expecting writes to continue when rotating fails: %v", err)
+		}
+	}
+	if current, _ := ioutil.ReadFile(path); string(current) != "first\nsecond\n" {
+		t.Errorf("Expecting the current file to be kept, got %q", current)
+	}
+
+	// rotating is retried on the next write
+	now = now.Add(time.Second)
+	if _, err := r.Write([]byte("third\n")); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := ioutil.ReadFile(path); string(current) != "third\n" {
+		t.Errorf("Expecting the file to be rotated once it can be, got %q", current)
+	}
+}
+
+func TestBackupsIgnoreOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	other := filepath.Join(dir, "audit-webhook.log")
+	if err := ioutil.WriteFile(other, []byte("other\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openRotatingFile(path, 5, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	now := time.Date(2018, 4, 21, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		r.Write([]byte(line))
+	}
+
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("Expecting a file that isn't a backup to be kept: %v", err)
+	}
+	if backups := r.backups(); len(backups) != 1 || strings.Contains(backups[0], "webhook") {
+		t.Errorf("Expecting only the newest backup, got %v", backups)
+	}
+}
@@ -0,0 +1,90 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package clusterstate
+
+import (
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// A copy of the cluster's objects, for rules that depend on more than the
+// object being admitted, e.g. how many external load balancers a namespace
+// already has. The copy is kept up to date by a Watcher, or filled directly
+// in tests.
+
+// The cluster's Services
+type Services struct {
+	lock     sync.RWMutex
+	services map[string]corev1.Service
+	synced   bool
+}
+
+func NewServices() *Services {
+	return &Services{services: map[string]corev1.Service{}}
+}
+
+func key(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// Replace every Service, e.g. after listing them, and mark the copy as
+// complete
+func (s *Services) Replace(services []corev1.Service) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.services = make(map[string]corev1.Service, len(services))
+	for _, service := range services {
+		s.services[key(service.Namespace, service.Name)] = service
+	}
+	s.synced = true
+}
+
+// Mark the copy as incomplete, e.g. after a list fails, until the next
+// Replace
+func (s *Services) MarkStale() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.synced = false
+}
+
+// Add or update a Service
+func (s *Services) Update(service corev1.Service) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.services[key(service.Namespace, service.Name)] = service
+}
+
+func (s *Services) Delete(namespace, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.services, key(namespace, name))
+}
+
+// The Services in the namespace, by name, and whether they've been listed yet
+func (s *Services) List(namespace string) ([]corev1.Service, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var services []corev1.Service
+	for _, service := range s.services {
+		if service.Namespace == namespace {
+			services = append(services, service)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services, s.synced
+}
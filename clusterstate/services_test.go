@@ -0,0 +1,190 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package clusterstate
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func service(namespace, name string) corev1.Service {
+	return corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+}
+
+func names(services []corev1.Service) []string {
+	var names []string
+	for _, s := range services {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func TestServices(t *testing.T) {
+	services := NewServices()
+	if _, synced := services.List("default"); synced {
+		t.Error("Expecting services not to be synced before they're listed")
+	}
+
+	services.Replace([]corev1.Service{service("default", "b"), service("default", "a"), service("other", "c")})
+	services.Update(service("default", "d"))
+	services.Delete("default", "b")
+
+	list, synced := services.List("default")
+	if !synced || fmt.Sprint(names(list)) != "[a d]" {
+		t.Errorf("Unexpected services %v, synced %v", names(list), synced)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("watch") == "" {
+			fmt.Fprint(w, `{"metadata":{"resourceVersion":"10"},"items":[{"metadata":{"namespace":"default","name":"a"}},{"metadata":{"namespace":"default","name":"b"}}]}`)
+			return
+		}
+		if r.URL.Query().Get("resourceVersion") != "10" {
+			// block later watches until the test ends
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, `{"type":"ADDED","object":{"metadata":{"namespace":"default","name":"c","resourceVersion":"11"}}}`)
+		fmt.Fprint(w, `{"type":"DELETED","object":{"metadata":{"namespace":"default","name":"a","resourceVersion":"12"}}}`)
+	}))
+	defer server.Close()
+
+	services := NewServices()
+	stop := make(chan struct{})
+	defer close(stop)
+	go (&Watcher{Host: server.URL, Token: "token", Client: server.Client()}).Run(services, stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list, synced := services.List("default")
+		if synced && fmt.Sprint(names(list)) == "[b c]" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expecting the watched changes to be applied, got %v", names(list))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatcherRereadsToken(t *testing.T) {
+	file, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	expected := atomic.Value{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+expected.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	watcher := &Watcher{Host: server.URL, TokenFile: file.Name(), Client: server.Client()}
+
+	for _, token := range []string{"token", "rotated"} {
+		if err := ioutil.WriteFile(file.Name(), []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		expected.Store(token)
+		resp, err := watcher.get(context.Background(), "/api/v1/services")
+		if err != nil {
+			t.Fatalf("Expecting the %s token to be used: %v", token, err)
+		}
+		resp.Body.Close()
+	}
+}
+
+// run a watcher against a server that lists no services, and fails the first
+// watch once the services have been synced, then wait for the services to be
+// marked stale. relist handles the later lists.
+func testMarksStale(t *testing.T, relist http.HandlerFunc) {
+	var lists int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") != "" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if atomic.AddInt32(&lists, 1) > 1 {
+			relist(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"metadata":{"resourceVersion":"10"},"items":[]}`)
+	}))
+	defer server.Close()
+
+	services := NewServices()
+	stop := make(chan struct{})
+	defer close(stop)
+	go (&Watcher{Host: server.URL, Client: server.Client()}).Run(services, stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, synced := services.List("default"); synced {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expecting the services to be listed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	for {
+		if _, synced := services.List("default"); !synced {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expecting the services to be marked stale")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatcherMarksStaleWhenRelistingFails(t *testing.T) {
+	testMarksStale(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+}
+
+// the copy is stale from when the watch fails, not only once relisting fails
+func TestWatcherMarksStaleWhenWatchFails(t *testing.T) {
+	testMarksStale(t, func(w http.ResponseWriter, r *http.Request) {
+		// block the relist until the test ends
+		<-r.Context().Done()
+	})
+}
@@ -0,0 +1,219 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package clusterstate
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// how long each watch request runs before it's restarted
+	watchTimeout = 5 * time.Minute
+	maxBackoff   = time.Minute
+)
+
+// Keeps Services up to date by listing and then watching the API server's
+// Services, relisting whenever the watch fails. Needs RBAC permission to list
+// and watch services in every namespace.
+type Watcher struct {
+	// The API server, e.g. https://10.0.0.1:443
+	Host  string
+	Token string
+	// Read the token from this file for each request, rather than using
+	// Token, as projected service account tokens are rotated
+	TokenFile string
+	Client    *http.Client
+}
+
+// A watcher using the pod's service account
+func InClusterWatcher() (*Watcher, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are unset")
+	}
+	// check the token can be read, rather than failing every request
+	if _, err := ioutil.ReadFile(serviceAccountDir + "/token"); err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+
+	return &Watcher{
+		Host:      "https://" + net.JoinHostPort(host, port),
+		TokenFile: serviceAccountDir + "/token",
+		Client:    &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}},
+	}, nil
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Keep the Services up to date until stop is closed
+func (w *Watcher) Run(services *Services, stop <-chan struct{}) {
+	// cancel the request in progress when stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := time.Second
+	for {
+		resourceVersion, err := w.list(ctx, services)
+		if err == nil {
+			backoff = time.Second
+		}
+		for err == nil {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			resourceVersion, err = w.watch(ctx, services, resourceVersion)
+		}
+		// whether listing or watching failed, changes may be missed until
+		// the next list succeeds, so the copy can't be relied on
+		services.MarkStale()
+		glog.Warningf("Watching services failed, relisting in %v: %v", backoff, err)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (w *Watcher) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", w.Host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	token, err := w.token()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (w *Watcher) token() (string, error) {
+	if w.TokenFile == "" {
+		return w.Token, nil
+	}
+	token, err := ioutil.ReadFile(w.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// list every Service, returning the resource version to watch from
+func (w *Watcher) list(ctx context.Context, services *Services) (string, error) {
+	resp, err := w.get(ctx, "/api/v1/services")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var list corev1.ServiceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+	services.Replace(list.Items)
+	glog.V(2).Infof("Listed %d services at resource version %s", len(list.Items), list.ResourceVersion)
+	return list.ResourceVersion, nil
+}
+
+// apply the changes to Services until the watch ends, returning the resource
+// version to continue from
+func (w *Watcher) watch(ctx context.Context, services *Services, resourceVersion string) (string, error) {
+	resp, err := w.get(ctx, fmt.Sprintf("/api/v1/services?watch=1&resourceVersion=%s&timeoutSeconds=%d", resourceVersion, int(watchTimeout.Seconds())))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err == io.EOF {
+			// the API server ends the watch after the timeout
+			return resourceVersion, nil
+		} else if err != nil {
+			return "", err
+		}
+
+		if event.Type == "ERROR" {
+			var status metav1.Status
+			json.Unmarshal(event.Object, &status)
+			return "", fmt.Errorf("watch error: %s", status.Message)
+		}
+		var service corev1.Service
+		if err := json.Unmarshal(event.Object, &service); err != nil {
+			return "", err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			services.Update(service)
+		case "DELETED":
+			services.Delete(service.Namespace, service.Name)
+		}
+		resourceVersion = service.ResourceVersion
+	}
+}
@@ -0,0 +1,116 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/benburry/k8s-admission-webhooks/handlers"
+)
+
+// Replace the active handlers and message templates with the configured
+// ones, at once
+func (c *Config) Apply() error {
+	set, err := c.Build()
+	if err != nil {
+		return err
+	}
+
+	handlers.SetHandlers(set)
+	return nil
+}
+
+// Construct every configured handler, with the message templates, without
+// making them active
+func (c *Config) Build() (*handlers.HandlerSet, error) {
+	set := handlers.NewHandlerSet()
+	if err := set.SetMessageTemplates(c.Messages); err != nil {
+		return nil, err
+	}
+	for _, h := range c.Handlers {
+		policy, err := h.build()
+		if err != nil {
+			return nil, fmt.Errorf("handlers[%s]: %v", h.Name, err)
+		}
+
+		set.Register(h.path(), policy)
+		for _, rule := range h.matchRules() {
+			set.RegisterDispatch(rule, policy)
+		}
+	}
+	return set, nil
+}
+
+// The names of the handlers configured to count the cluster's Services,
+// which need a handlers.ServiceLister
+func (c *Config) ServiceCounters() []string {
+	var names []string
+	for _, h := range c.Handlers {
+		// handlers that can't be built are reported by Validate
+		if policy, err := h.build(); err == nil {
+			if counter, ok := policy.Handler.(handlers.ServiceCounter); ok && counter.CountsServices() {
+				names = append(names, h.Name)
+			}
+		}
+	}
+	return names
+}
+
+// construct the configured handler, with its parameters applied
+func (h *HandlerConfig) build() (*handlers.Policy, error) {
+	factory, found := handlers.GetHandlerFactory(h.Name)
+	if !found {
+		return nil, fmt.Errorf("unknown handler '%s'", h.Name)
+	}
+	handler := factory.New()
+
+	if p, ok := handler.(handlers.ParameterizedHandler); ok {
+		if err := p.SetParameters(h.decodeParameters); err != nil {
+			return nil, fmt.Errorf("invalid parameters: %v", err)
+		}
+	} else if len(h.Parameters) > 0 {
+		return nil, fmt.Errorf("handler takes no parameters")
+	}
+
+	enforcement := h.Enforcement
+	if enforcement == "" {
+		enforcement = handlers.EnforcementEnforce
+	}
+
+	return &handlers.Policy{
+		Name:        h.Name,
+		Description: factory.Description,
+		Handler:     handler,
+		Enforcement: enforcement,
+		Exemptions:  h.Exemptions,
+		Concurrency: h.Concurrency,
+		Cache:       h.Cache,
+	}, nil
+}
+
+// unmarshal the handler's parameters into the given struct, refusing unknown
+// parameters
+func (h *HandlerConfig) decodeParameters(into interface{}) error {
+	if len(h.Parameters) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(h.Parameters)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, into)
+}
@@ -0,0 +1,307 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/benburry/k8s-admission-webhooks/audit"
+	"github.com/benburry/k8s-admission-webhooks/export"
+	"github.com/benburry/k8s-admission-webhooks/handlers"
+	"github.com/benburry/k8s-admission-webhooks/notify"
+)
+
+// The configuration file, describing which handlers are enabled and how they
+// behave. See the example in the README for details.
+
+type Config struct {
+	Server   ServerConfig                        `yaml:"server"`
+	Messages map[string]handlers.MessageTemplate `yaml:"messages"`
+	Handlers []HandlerConfig                     `yaml:"handlers"`
+	// Write every decision to an audit log
+	Audit *audit.Options `yaml:"audit"`
+	// Send every decision to an HTTP endpoint as CloudEvents
+	Export *export.Options `yaml:"export"`
+	// Tell people when their objects are rejected
+	Notifications *notify.Options `yaml:"notifications"`
+}
+
+type ServerConfig struct {
+	Addr        string `yaml:"addr"`
+	TLSCertFile string `yaml:"tlsCert"`
+	TLSKeyFile  string `yaml:"tlsKey"`
+	// Bearer tokens accepted by the admin endpoints, one per line
+	AdminTokenFile string `yaml:"adminTokenFile"`
+	// Denials and warnings kept for /debug/decisions. Defaults to 500.
+	RecentDecisions *int `yaml:"recentDecisions"`
+}
+
+type HandlerConfig struct {
+	// The name of a built-in handler
+	Name string `yaml:"name"`
+	// The path the handler is served on. Defaults to the handler's default
+	// path.
+	Path string `yaml:"path"`
+	// Also serve the handler from the dispatch endpoint, for requests
+	// matching any of these rules. Defaults to the handler's default rules;
+	// an empty list disables dispatch for the handler. Mutating handlers are
+	// never dispatched.
+	Rules       []RuleConfig             `yaml:"rules"`
+	Enforcement handlers.EnforcementMode `yaml:"enforcement"`
+	Exemptions  handlers.Exemptions      `yaml:"exemptions"`
+	// Limit the requests the handler reviews at once
+	Concurrency *handlers.ConcurrencyLimit `yaml:"concurrency"`
+	// Cache the handler's results for identical requests
+	Cache *handlers.CacheOptions `yaml:"cache"`
+	// Handler-specific parameters
+	Parameters yaml.MapSlice `yaml:"parameters"`
+}
+
+type RuleConfig struct {
+	Operations  []string `yaml:"operations"`
+	APIGroups   []string `yaml:"apiGroups"`
+	APIVersions []string `yaml:"apiVersions"`
+	Resources   []string `yaml:"resources"`
+}
+
+// Every problem found with a configuration file
+type Errors []string
+
+func (e Errors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// The configuration used when no file is given: every registered handler
+// (except those disabled by default) on its default path, and routed by
+// resource from the dispatch endpoint
+func Default() *Config {
+	config := &Config{}
+	for _, factory := range handlers.GetHandlerFactories() {
+		if factory.DisabledByDefault {
+			continue
+		}
+		config.Handlers = append(config.Handlers, HandlerConfig{Name: factory.Name})
+	}
+	return config
+}
+
+// Restrict the configured handlers to those named in enable (if any are
+// named), adding any that aren't configured with their defaults, then remove
+// those named in disable
+func (c *Config) SelectHandlers(enable, disable []string) error {
+	for _, name := range append(append([]string{}, enable...), disable...) {
+		if _, found := handlers.GetHandlerFactory(name); !found {
+			return fmt.Errorf("unknown handler '%s'", name)
+		}
+	}
+
+	var selected []HandlerConfig
+	if len(enable) > 0 {
+		for _, name := range enable {
+			h := HandlerConfig{Name: name}
+			for _, configured := range c.Handlers {
+				if configured.Name == name {
+					h = configured
+				}
+			}
+			selected = append(selected, h)
+		}
+	} else {
+		selected = c.Handlers
+	}
+
+	c.Handlers = nil
+	for _, h := range selected {
+		if !contains(disable, h.Name) {
+			c.Handlers = append(c.Handlers, h)
+		}
+	}
+	return nil
+}
+
+func Load(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse and validate a configuration file
+func Parse(data []byte) (*Config, error) {
+	config := Config{}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Check the configuration against everything the schema can't express,
+// building each handler to validate its parameters
+func (c *Config) Validate() error {
+	var errs Errors
+
+	if err := handlers.ValidateMessageTemplates(c.Messages); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if c.Server.RecentDecisions != nil && *c.Server.RecentDecisions < 0 {
+		errs = append(errs, "server: recentDecisions must not be negative")
+	}
+
+	if c.Audit != nil {
+		if err := c.Audit.Validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("audit: %v", err))
+		}
+	}
+
+	if c.Export != nil {
+		if err := c.Export.Validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("export: %v", err))
+		}
+	}
+
+	if c.Notifications != nil {
+		if err := c.Notifications.Validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("notifications: %v", err))
+		}
+	}
+
+	names := map[string]bool{}
+	paths := map[string]string{}
+	for i, h := range c.Handlers {
+		prefix := fmt.Sprintf("handlers[%d]", i)
+		if h.Name != "" {
+			prefix = fmt.Sprintf("handlers[%s]", h.Name)
+		}
+
+		if h.Name == "" {
+			errs = append(errs, prefix+": name is required")
+		} else if names[h.Name] {
+			errs = append(errs, prefix+": handler is configured more than once")
+		}
+		names[h.Name] = true
+
+		path := h.path()
+		if !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Sprintf("%s: path '%s' must start with '/'", prefix, path))
+		} else if handlers.ReservedPath(path) {
+			errs = append(errs, fmt.Sprintf("%s: path '%s' is reserved for the server's own endpoints", prefix, path))
+		} else if other, found := paths[path]; found {
+			errs = append(errs, fmt.Sprintf("%s: path '%s' is already used by handler '%s'", prefix, path, other))
+		}
+		paths[path] = h.Name
+
+		if !h.Enforcement.Valid() {
+			errs = append(errs, fmt.Sprintf("%s: enforcement must be one of '%s', '%s' or '%s', not '%s'", prefix,
+				handlers.EnforcementEnforce, handlers.EnforcementWarn, handlers.EnforcementDryRun, h.Enforcement))
+		}
+
+		for _, namespace := range h.Exemptions.Namespaces {
+			for _, msg := range validation.IsDNS1123Label(namespace) {
+				errs = append(errs, fmt.Sprintf("%s: exempt namespace '%s': %s", prefix, namespace, msg))
+			}
+		}
+
+		if h.Concurrency != nil {
+			if err := h.Concurrency.Validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: concurrency: %v", prefix, err))
+			}
+		}
+
+		if h.Cache != nil {
+			if err := h.Cache.Validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: cache: %v", prefix, err))
+			}
+		}
+
+		if factory, found := handlers.GetHandlerFactory(h.Name); found && factory.Mutating && len(h.Rules) > 0 {
+			errs = append(errs, fmt.Sprintf("%s: rules: a mutating handler can't be served from the dispatch endpoint", prefix))
+		}
+
+		for j, rule := range h.Rules {
+			for _, operation := range rule.Operations {
+				switch v1beta1.Operation(operation) {
+				case v1beta1.Create, v1beta1.Update, v1beta1.Delete, v1beta1.Connect, "*":
+				default:
+					errs = append(errs, fmt.Sprintf("%s: rules[%d]: unknown operation '%s'", prefix, j, operation))
+				}
+			}
+		}
+
+		if h.Name != "" {
+			if _, err := h.build(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", prefix, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (h *HandlerConfig) path() string {
+	if h.Path != "" {
+		return h.Path
+	}
+	if factory, found := handlers.GetHandlerFactory(h.Name); found {
+		return factory.DefaultPath
+	}
+	return "/" + h.Name
+}
+
+func (h *HandlerConfig) matchRules() []handlers.MatchRule {
+	factory, _ := handlers.GetHandlerFactory(h.Name)
+	if factory.Mutating {
+		return nil
+	}
+	if h.Rules == nil {
+		return factory.DefaultRules
+	}
+
+	rules := make([]handlers.MatchRule, len(h.Rules))
+	for i, rule := range h.Rules {
+		rules[i] = rule.matchRule()
+	}
+	return rules
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RuleConfig) matchRule() handlers.MatchRule {
+	rule := handlers.MatchRule{APIGroups: r.APIGroups, APIVersions: r.APIVersions, Resources: r.Resources}
+	for _, operation := range r.Operations {
+		rule.Operations = append(rule.Operations, v1beta1.Operation(operation))
+	}
+	return rule
+}
@@ -0,0 +1,221 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/benburry/k8s-admission-webhooks/handlers"
+)
+
+var exampleConfig = `
+server:
+  addr: ":8443"
+messages:
+  gkepublicservice.opt-in:
+    template: "{{.Name}} would be public, see {{.DocumentationURL}}"
+    documentationURL: https://wiki.example.com/public-services
+handlers:
+  - name: gkepublicservice
+    enforcement: warn
+    exemptions:
+      namespaces: [kube-system]
+      groups: ["system:masters"]
+    rules:
+      - operations: [CREATE, UPDATE]
+        apiGroups: [""]
+        apiVersions: [v1]
+        resources: [services]
+  - name: prometheuslinter
+    path: /lint
+`
+
+func TestParseExample(t *testing.T) {
+	config, err := Parse([]byte(exampleConfig))
+	if err != nil {
+		t.Fatalf("Expecting example configuration to be valid: %v", err)
+	}
+
+	if config.Server.Addr != ":8443" {
+		t.Errorf("Unexpected addr %s", config.Server.Addr)
+	}
+	if len(config.Handlers) != 2 {
+		t.Fatalf("Expecting 2 handlers, got %d", len(config.Handlers))
+	}
+	if path := config.Handlers[0].path(); path != "/gkepublicservice" {
+		t.Errorf("Expecting default path, got %s", path)
+	}
+	if path := config.Handlers[1].path(); path != "/lint" {
+		t.Errorf("Expecting configured path, got %s", path)
+	}
+
+	policy, err := config.Handlers[0].build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Enforcement != handlers.EnforcementWarn || policy.Exemptions.Namespaces[0] != "kube-system" {
+		t.Errorf("Unexpected policy %+v", policy)
+	}
+
+	if policy, _ := config.Handlers[1].build(); policy.Enforcement != handlers.EnforcementEnforce {
+		t.Errorf("Expecting enforcement to default to enforce, got %s", policy.Enforcement)
+	}
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Errorf("Expecting default configuration to be valid: %v", err)
+	}
+}
+
+func TestUnknownFieldsRefused(t *testing.T) {
+	if _, err := Parse([]byte("handlers:\n  - name: gkepublicservice\n    enforcment: warn\n")); err == nil {
+		t.Error("Expecting unknown field to be refused")
+	}
+}
+
+func TestEveryErrorReported(t *testing.T) {
+	_, err := Parse([]byte(`
+messages:
+  test:
+    template: "{{.Name"
+handlers:
+  - name: unknown
+  - name: gkepublicservice
+    path: /validate
+    enforcement: sometimes
+    exemptions:
+      namespaces: [Not_A_Namespace]
+    rules:
+      - operations: [PATCH]
+  - name: gkepublicservice
+  - name: prometheuslinter
+    parameters:
+      strict: true
+`))
+
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("Expecting configuration errors, got %v", err)
+	}
+
+	expected := []string{
+		"invalid message template for rule 'test'",
+		"handlers[unknown]: unknown handler 'unknown'",
+		"handlers[gkepublicservice]: path '/validate' is reserved",
+		"handlers[gkepublicservice]: enforcement must be one of",
+		"handlers[gkepublicservice]: exempt namespace 'Not_A_Namespace'",
+		"handlers[gkepublicservice]: rules[0]: unknown operation 'PATCH'",
+		"handlers[gkepublicservice]: handler is configured more than once",
+		"handlers[prometheuslinter]: handler takes no parameters",
+	}
+	for _, e := range expected {
+		found := false
+		for _, actual := range errs {
+			if strings.HasPrefix(actual, e) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expecting error %q in %v", e, errs)
+		}
+	}
+}
+
+func TestReservedPaths(t *testing.T) {
+	for _, path := range []string{"/validate", "/metrics", "/policies", "/debug/decisions"} {
+		_, err := Parse([]byte("handlers:\n  - name: gkepublicservice\n    path: " + path + "\n"))
+		if err == nil || !strings.Contains(err.Error(), "reserved") {
+			t.Errorf("Expecting path %s to be refused, got %v", path, err)
+		}
+	}
+}
+
+func TestSelectHandlers(t *testing.T) {
+	config, err := Parse([]byte(exampleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := config.SelectHandlers([]string{"prometheuslinter"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Handlers) != 1 || config.Handlers[0].Name != "prometheuslinter" || config.Handlers[0].Path != "/lint" {
+		t.Errorf("Expecting only the configured prometheuslinter handler to be enabled, got %+v", config.Handlers)
+	}
+
+	config = Default()
+	if err := config.SelectHandlers(nil, []string{"prometheuslinter"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Handlers) != 1 || config.Handlers[0].Name != "gkepublicservice" {
+		t.Errorf("Expecting prometheuslinter to be disabled, got %+v", config.Handlers)
+	}
+
+	config = &Config{}
+	if err := config.SelectHandlers([]string{"gkepublicservice"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Handlers) != 1 || config.Handlers[0].path() != "/gkepublicservice" {
+		t.Errorf("Expecting unconfigured handler to be enabled with its defaults, got %+v", config.Handlers)
+	}
+
+	if err := Default().SelectHandlers(nil, []string{"unknown"}); err == nil {
+		t.Error("Expecting unknown handler to be refused")
+	}
+}
+
+func TestDefaultRules(t *testing.T) {
+	config, err := Parse([]byte("handlers:\n  - name: gkepublicservice\n  - name: prometheuslinter\n    rules: []\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rules := config.Handlers[0].matchRules(); len(rules) != 1 || rules[0].Resources[0] != "services" {
+		t.Errorf("Expecting the handler's default rules, got %+v", rules)
+	}
+	if rules := config.Handlers[1].matchRules(); len(rules) != 0 {
+		t.Errorf("Expecting an empty list to disable dispatch, got %+v", rules)
+	}
+}
+
+func TestMutatingHandlersNotDispatched(t *testing.T) {
+	config, err := Parse([]byte("handlers:\n  - name: gkeinternalservice\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := config.Handlers[0].matchRules(); len(rules) != 0 {
+		t.Errorf("Expecting a mutating handler not to be dispatched, got %+v", rules)
+	}
+
+	_, err = Parse([]byte("handlers:\n  - name: gkeinternalservice\n    rules:\n      - operations: [CREATE]\n        apiGroups: ['']\n        apiVersions: [v1]\n        resources: [services]\n"))
+	if err == nil || !strings.Contains(err.Error(), "mutating") {
+		t.Errorf("Expecting rules for a mutating handler to be refused, got %v", err)
+	}
+}
+
+func TestServiceCounters(t *testing.T) {
+	config, err := Parse([]byte("handlers:\n  - name: gkepublicservice\n    parameters:\n      loadBalancerQuota:\n        limits: {\"*\": 2}\n  - name: gkeinternalservice\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters := config.ServiceCounters(); len(counters) != 1 || counters[0] != "gkepublicservice" {
+		t.Errorf("Expecting only the handler with a quota to count services, got %v", counters)
+	}
+	if counters := Default().ServiceCounters(); len(counters) != 0 {
+		t.Errorf("Expecting no handlers to count services by default, got %v", counters)
+	}
+}
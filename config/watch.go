@@ -0,0 +1,161 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Poll the configuration file for changes, applying each new version once it
+// has been validated. Polling (rather than inotify) copes with the symlink
+// swaps Kubernetes makes when updating a mounted ConfigMap.
+//
+// A version that fails validation is logged and counted, and the current
+// configuration is left in place.
+
+var (
+	reloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "admission_webhook",
+		Name:      "config_reloads_total",
+		Help:      "Configuration file reloads, by result.",
+	}, []string{"result"})
+	lastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "admission_webhook",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last attempt to reload the configuration file succeeded.",
+	})
+	lastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "admission_webhook",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Time of the last successful configuration load.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(reloads, lastReloadSuccessful, lastReloadSuccess)
+}
+
+type Watcher struct {
+	// Called on every version of the file before it's validated, e.g. to
+	// apply command line overrides
+	Adjust func(config *Config) error
+
+	filename string
+	interval time.Duration
+
+	// the last version of the file seen, whether or not it was valid
+	checksum [sha256.Size]byte
+	current  *Config
+}
+
+func NewWatcher(filename string, interval time.Duration) *Watcher {
+	return &Watcher{filename: filename, interval: interval}
+}
+
+// Load and apply the configuration file for the first time
+func (w *Watcher) Load() (*Config, error) {
+	data, err := ioutil.ReadFile(w.filename)
+	if err != nil {
+		return nil, err
+	}
+	config, err := w.parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Apply(); err != nil {
+		return nil, err
+	}
+
+	w.checksum = sha256.Sum256(data)
+	w.current = config
+	lastReloadSuccessful.Set(1)
+	lastReloadSuccess.Set(float64(time.Now().Unix()))
+	return config, nil
+}
+
+// Check the file for changes every interval, until stop is closed
+func (w *Watcher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.reload()
+		}
+	}
+}
+
+// apply the file if it has changed since it was last seen, returning whether
+// a new configuration was applied
+func (w *Watcher) reload() bool {
+	data, err := ioutil.ReadFile(w.filename)
+	if err != nil {
+		// the file may be briefly missing while a ConfigMap is updated, so
+		// keep polling
+		glog.Warningf("Unable to read configuration file %s: %v", w.filename, err)
+		return false
+	}
+
+	checksum := sha256.Sum256(data)
+	if bytes.Equal(checksum[:], w.checksum[:]) {
+		return false
+	}
+	w.checksum = checksum
+
+	config, err := w.parse(data)
+	if err == nil {
+		err = config.Apply()
+	}
+	if err != nil {
+		glog.Errorf("Not reloading configuration file %s, keeping the current configuration:\n%v", w.filename, err)
+		reloads.WithLabelValues("failure").Inc()
+		lastReloadSuccessful.Set(0)
+		return false
+	}
+
+	if !reflect.DeepEqual(config.Server, w.current.Server) || !reflect.DeepEqual(config.Audit, w.current.Audit) ||
+		!reflect.DeepEqual(config.Export, w.current.Export) || !reflect.DeepEqual(config.Notifications, w.current.Notifications) {
+		glog.Warningf("Server, audit, export or notification settings in %s have changed, and will only be applied on restart", w.filename)
+	}
+
+	glog.Infof("Reloaded configuration file %s", w.filename)
+	w.current = config
+	reloads.WithLabelValues("success").Inc()
+	lastReloadSuccessful.Set(1)
+	lastReloadSuccess.Set(float64(time.Now().Unix()))
+	return true
+}
+
+func (w *Watcher) parse(data []byte) (*Config, error) {
+	config, err := Parse(data)
+	if err != nil || w.Adjust == nil {
+		return config, err
+	}
+
+	if err := w.Adjust(config); err != nil {
+		return nil, err
+	}
+	return config, config.Validate()
+}
@@ -0,0 +1,76 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benburry/k8s-admission-webhooks/handlers"
+)
+
+func writeConfig(t *testing.T, filename, content string) {
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func registeredPath(path string) bool {
+	_, found := handlers.GetRegisteredHandlers()[path]
+	return found
+}
+
+func TestWatcherReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer handlers.SetHandlers(handlers.NewHandlerSet())
+
+	filename := filepath.Join(dir, "config.yaml")
+	writeConfig(t, filename, "handlers:\n  - name: gkepublicservice\n")
+
+	watcher := NewWatcher(filename, time.Hour)
+	if _, err := watcher.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !registeredPath("/gkepublicservice") {
+		t.Fatal("Expecting initial configuration to be applied")
+	}
+
+	if watcher.reload() {
+		t.Error("Expecting an unchanged file not to be reloaded")
+	}
+
+	writeConfig(t, filename, "handlers:\n  - name: gkepublicservice\n    enforcement: sometimes\n")
+	if watcher.reload() {
+		t.Error("Expecting an invalid file not to be applied")
+	}
+	if !registeredPath("/gkepublicservice") {
+		t.Error("Expecting the current configuration to be kept after an invalid reload")
+	}
+
+	writeConfig(t, filename, "handlers:\n  - name: prometheuslinter\n")
+	if !watcher.reload() {
+		t.Error("Expecting a changed file to be reloaded")
+	}
+	if registeredPath("/gkepublicservice") || !registeredPath("/prometheuslinter") {
+		t.Error("Expecting the new configuration to replace the old")
+	}
+}
@@ -0,0 +1,340 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/benburry/k8s-admission-webhooks/audit"
+	"github.com/benburry/k8s-admission-webhooks/handlers"
+)
+
+// Export every decision to an HTTP endpoint as a CloudEvent, using the JSON
+// batched content mode (https://github.com/cloudevents/spec).
+//
+// Decisions are queued in memory and sent asynchronously in batches, so a
+// slow or unavailable receiver never delays an admission. When the queue is
+// full, new decisions are dropped and counted. Batches that fail to send are
+// retried with exponential backoff, then dropped and counted.
+
+const (
+	EventType        = "com.github.benburry.k8s-admission-webhooks.decision"
+	batchContentType = "application/cloudevents-batch+json"
+)
+
+var (
+	exported = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "admission_webhook",
+		Name:      "export_events_total",
+		Help:      "Decisions successfully exported.",
+	})
+	dropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "admission_webhook",
+		Name:      "export_events_dropped_total",
+		Help:      "Decisions dropped without being exported, by reason.",
+	}, []string{"reason"})
+	sendAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "admission_webhook",
+		Name:      "export_requests_total",
+		Help:      "Requests made to the export endpoint, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(exported, dropped, sendAttempts)
+}
+
+type Options struct {
+	// The endpoint batches of events are POSTed to
+	URL string `yaml:"url"`
+	// The CloudEvents source attribute. Defaults to "k8s-admission-webhooks".
+	Source string `yaml:"source"`
+	// The detail included in each event, as for the audit log. Defaults to
+	// violations.
+	Level audit.Level `yaml:"level"`
+	// Decisions held in memory waiting to be sent. Defaults to 10000.
+	QueueSize int `yaml:"queueSize"`
+	// The most events sent in one request. Defaults to 100.
+	BatchSize int `yaml:"batchSize"`
+	// How long to wait for a batch to fill before sending it anyway.
+	// Defaults to 5s.
+	FlushInterval time.Duration `yaml:"flushInterval"`
+	// Retries of a failed batch before it is dropped. Defaults to 5.
+	MaxRetries *int `yaml:"maxRetries"`
+	// The delay before the first retry, doubling for each retry after.
+	// Defaults to 1s.
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	// Defaults to 1m
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+	// Timeout for each request. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout"`
+	// Additional headers sent with each request, e.g. for authentication
+	Headers map[string]string `yaml:"headers"`
+}
+
+func (o *Options) Validate() error {
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url must be http or https, not '%s'", o.URL)
+	}
+	if !o.Level.Valid() {
+		return fmt.Errorf("level must be one of '%s', '%s' or '%s', not '%s'", audit.LevelMetadata, audit.LevelViolations, audit.LevelRequest, o.Level)
+	}
+	if o.QueueSize < 0 || o.BatchSize < 0 || (o.MaxRetries != nil && *o.MaxRetries < 0) {
+		return fmt.Errorf("queueSize, batchSize and maxRetries must not be negative")
+	}
+	if o.FlushInterval < 0 || o.InitialBackoff < 0 || o.MaxBackoff < 0 || o.Timeout < 0 {
+		return fmt.Errorf("flushInterval, initialBackoff, maxBackoff and timeout must not be negative")
+	}
+	return nil
+}
+
+func (o Options) withDefaults() Options {
+	if o.Source == "" {
+		o.Source = "k8s-admission-webhooks"
+	}
+	if o.QueueSize == 0 {
+		o.QueueSize = 10000
+	}
+	if o.BatchSize == 0 {
+		o.BatchSize = 100
+	}
+	if o.FlushInterval == 0 {
+		o.FlushInterval = 5 * time.Second
+	}
+	if o.MaxRetries == nil {
+		retries := 5
+		o.MaxRetries = &retries
+	}
+	if o.InitialBackoff == 0 {
+		o.InitialBackoff = time.Second
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = time.Minute
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+	return o
+}
+
+// A decision, in the CloudEvents JSON format
+type Event struct {
+	SpecVersion     string       `json:"specversion"`
+	ID              string       `json:"id"`
+	Source          string       `json:"source"`
+	Type            string       `json:"type"`
+	Subject         string       `json:"subject,omitempty"`
+	Time            time.Time    `json:"time"`
+	DataContentType string       `json:"datacontenttype"`
+	Data            *audit.Entry `json:"data"`
+}
+
+type Exporter struct {
+	options Options
+	client  *http.Client
+	queue   chan *handlers.Decision
+	stop    chan struct{}
+	done    chan struct{}
+
+	// held while recording, so that nothing is queued once closed
+	lock   sync.RWMutex
+	closed bool
+}
+
+// Create an exporter, and start sending decisions recorded with it
+func NewExporter(options Options) (*Exporter, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	options = options.withDefaults()
+
+	e := &Exporter{
+		options: options,
+		client:  &http.Client{Timeout: options.Timeout},
+		queue:   make(chan *handlers.Decision, options.QueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "admission_webhook",
+		Name:      "export_queue_length",
+		Help:      "Decisions waiting to be exported.",
+	}, func() float64 { return float64(len(e.queue)) }))
+
+	go e.run()
+	return e, nil
+}
+
+// Queue the decision to be exported, dropping it if the queue is full
+func (e *Exporter) Record(decision *handlers.Decision) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.closed {
+		dropped.WithLabelValues("closed").Inc()
+		return
+	}
+
+	select {
+	case e.queue <- decision:
+	default:
+		dropped.WithLabelValues("queue_full").Inc()
+		glog.V(2).Infof("Export queue full, dropping decision %s", decision.UID)
+	}
+}
+
+// Send any queued decisions, then stop. Decisions recorded after Close are
+// not exported.
+func (e *Exporter) Close() {
+	e.lock.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.stop)
+	}
+	e.lock.Unlock()
+	<-e.done
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.options.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*handlers.Decision, 0, e.options.BatchSize)
+	for {
+		select {
+		case decision := <-e.queue:
+			batch = append(batch, decision)
+			if len(batch) < e.options.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.stop:
+			// nothing more is queued once stopped, so send what's left
+			for {
+				select {
+				case decision := <-e.queue:
+					if batch = append(batch, decision); len(batch) >= e.options.BatchSize {
+						e.send(batch)
+						batch = batch[:0]
+					}
+				default:
+					e.send(batch)
+					return
+				}
+			}
+		}
+
+		e.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send a batch, retrying with backoff until it succeeds or the retries are
+// exhausted
+func (e *Exporter) send(batch []*handlers.Decision) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e.events(batch))
+	if err != nil {
+		glog.Errorf("Unable to encode %d decisions for export: %v", len(batch), err)
+		dropped.WithLabelValues("encoding").Add(float64(len(batch)))
+		return
+	}
+
+	backoff := e.options.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := e.post(body)
+		if err == nil {
+			sendAttempts.WithLabelValues("success").Inc()
+			exported.Add(float64(len(batch)))
+			return
+		}
+		sendAttempts.WithLabelValues("failure").Inc()
+
+		if attempt >= *e.options.MaxRetries {
+			glog.Errorf("Dropping %d decisions after %d attempts to export them: %v", len(batch), attempt+1, err)
+			dropped.WithLabelValues("send_failed").Add(float64(len(batch)))
+			return
+		}
+
+		glog.Warningf("Unable to export %d decisions, retrying in %s: %v", len(batch), backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > e.options.MaxBackoff {
+			backoff = e.options.MaxBackoff
+		}
+	}
+}
+
+func (e *Exporter) post(body []byte) error {
+	req, err := http.NewRequest("POST", e.options.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", batchContentType)
+	for name, value := range e.options.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *Exporter) events(batch []*handlers.Decision) []Event {
+	events := make([]Event, len(batch))
+	for i, decision := range batch {
+		subject := decision.Name
+		if decision.Namespace != "" {
+			subject = decision.Namespace + "/" + decision.Name
+		}
+
+		events[i] = Event{
+			SpecVersion: "1.0",
+			// a request is decided by each matching handler, so the UID alone
+			// isn't unique
+			ID:              string(decision.UID) + "/" + decision.Handler,
+			Source:          e.options.Source,
+			Type:            EventType,
+			Subject:         subject,
+			Time:            decision.Time.UTC(),
+			DataContentType: "application/json",
+			Data:            audit.NewEntry(decision, e.options.Level),
+		}
+	}
+	return events
+}
@@ -0,0 +1,230 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/benburry/k8s-admission-webhooks/handlers"
+)
+
+// receiver records every batch POSTed to it, failing the first `failures`
+type receiver struct {
+	sync.Mutex
+	failures int
+	requests int
+	batches  [][]Event
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.requests++
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if ct := req.Header.Get("Content-Type"); ct != batchContentType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var batch []Event
+	if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.batches = append(r.batches, batch)
+}
+
+func (r *receiver) events() []Event {
+	r.Lock()
+	defer r.Unlock()
+
+	var events []Event
+	for _, batch := range r.batches {
+		events = append(events, batch...)
+	}
+	return events
+}
+
+func testDecision(i int) *handlers.Decision {
+	return &handlers.Decision{
+		Time:      time.Date(2018, 4, 21, 3, 19, 46, 0, time.UTC),
+		UID:       types.UID(fmt.Sprintf("uid-%d", i)),
+		Handler:   "gkepublicservice",
+		Namespace: "default",
+		Name:      "test-service",
+		Operation: "CREATE",
+		Outcome:   handlers.OutcomeDenied,
+		Message:   "The service 'test-service' is public",
+	}
+}
+
+func newTestExporter(t *testing.T, url string, options Options) *Exporter {
+	options.URL = url
+	if options.InitialBackoff == 0 {
+		options.InitialBackoff = time.Millisecond
+	}
+	e, err := NewExporter(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestBatching(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	e := newTestExporter(t, server.URL, Options{BatchSize: 2, FlushInterval: time.Hour})
+	for i := 0; i < 5; i++ {
+		e.Record(testDecision(i))
+	}
+	e.Close()
+
+	if len(r.batches) != 3 {
+		t.Errorf("Expecting 5 events in 3 batches, got %d batches", len(r.batches))
+	}
+	events := r.events()
+	if len(events) != 5 {
+		t.Fatalf("Expecting 5 events, got %d", len(events))
+	}
+
+	event := events[0]
+	if event.SpecVersion != "1.0" || event.Type != EventType || event.Source != "k8s-admission-webhooks" {
+		t.Errorf("Unexpected CloudEvents attributes %+v", event)
+	}
+	if event.ID != "uid-0/gkepublicservice" || event.Subject != "default/test-service" {
+		t.Errorf("Unexpected id '%s' or subject '%s'", event.ID, event.Subject)
+	}
+	if event.Data == nil || event.Data.Decision != handlers.OutcomeDenied || event.Data.Message == "" {
+		t.Errorf("Expecting the decision and its message as the event data, got %+v", event.Data)
+	}
+}
+
+func TestRecordAfterClose(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	e := newTestExporter(t, server.URL, Options{FlushInterval: time.Hour})
+	e.Record(testDecision(0))
+	e.Close()
+	e.Record(testDecision(1))
+	e.Close()
+
+	if events := r.events(); len(events) != 1 {
+		t.Errorf("Expecting only the decision recorded before Close to be exported, got %d", len(events))
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	e := newTestExporter(t, server.URL, Options{FlushInterval: 10 * time.Millisecond})
+	defer e.Close()
+	e.Record(testDecision(0))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.events()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expecting a partial batch to be sent after the flush interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	r := &receiver{failures: 2}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	e := newTestExporter(t, server.URL, Options{})
+	e.Record(testDecision(0))
+	e.Close()
+
+	if r.requests != 3 || len(r.events()) != 1 {
+		t.Errorf("Expecting the event to be sent on the third attempt, got %d attempts and %d events", r.requests, len(r.events()))
+	}
+
+	retries := 1
+	r = &receiver{failures: 5}
+	server2 := httptest.NewServer(r)
+	defer server2.Close()
+
+	e = newTestExporter(t, server2.URL, Options{MaxRetries: &retries})
+	e.Record(testDecision(0))
+	e.Close()
+
+	if r.requests != 2 || len(r.events()) != 0 {
+		t.Errorf("Expecting the event to be dropped after 2 attempts, got %d attempts and %d events", r.requests, len(r.events()))
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	r := &receiver{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-block
+		r.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+
+	e := newTestExporter(t, server.URL, Options{QueueSize: 2, BatchSize: 1})
+	// the first is taken from the queue and blocks sending, filling the queue
+	// with the next two
+	for i := 0; i < 10; i++ {
+		e.Record(testDecision(i))
+		time.Sleep(time.Millisecond)
+	}
+	close(block)
+	e.Close()
+
+	if n := len(r.events()); n < 2 || n > 3 {
+		t.Errorf("Expecting the decisions beyond the queue size to be dropped, got %d events", n)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, options := range []Options{
+		{URL: "ftp://example.com"},
+		{URL: "http://example.com", Level: "everything"},
+		{URL: "http://example.com", BatchSize: -1},
+		{URL: "http://example.com", FlushInterval: -time.Second},
+	} {
+		if err := options.Validate(); err == nil {
+			t.Errorf("Expecting %+v to be invalid", options)
+		}
+	}
+
+	options := Options{URL: "https://example.com/events"}
+	if err := options.Validate(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
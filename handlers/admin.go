@@ -0,0 +1,94 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// The read-only admin endpoints (such as /policies) require one of these
+// bearer tokens. With no tokens set, every request to them is refused.
+
+var adminTokens atomic.Value
+
+func init() {
+	adminTokens.Store([]string{})
+}
+
+func SetAdminTokens(tokens []string) {
+	adminTokens.Store(append([]string{}, tokens...))
+}
+
+// Read tokens from a file, one per line. Blank lines and lines starting with
+// '#' are ignored.
+func LoadAdminTokens(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	return tokens, scanner.Err()
+}
+
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, prefix) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admission-webhooks"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !validAdminToken(strings.TrimPrefix(header, prefix)) {
+			level.Warn(baseLogger()).Log("msg", "Refusing request with an invalid admin token", "method", r.Method, "path", r.URL.Path, "remoteAddr", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func validAdminToken(token string) bool {
+	valid := false
+	for _, t := range adminTokens.Load().([]string) {
+		// check every token, so the time taken doesn't reveal which matched
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
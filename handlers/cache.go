@@ -0,0 +1,187 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/admission/v1beta1"
+)
+
+// Cache each policy's results, so that identical objects resubmitted by
+// controllers aren't reviewed again. Results are keyed by the request's
+// resource, operation, namespace and user groups, and a hash of the object's
+// content. Each policy has its own cache, so reloading the configuration
+// starts afresh.
+
+type CacheOptions struct {
+	// The most results kept. Defaults to 1000.
+	Size int `yaml:"size" json:"size"`
+	// How long a result is kept. Defaults to 5m.
+	TTL time.Duration `yaml:"ttl" json:"ttl"`
+}
+
+func (o *CacheOptions) Validate() error {
+	if o.Size < 0 || o.TTL < 0 {
+		return fmt.Errorf("size and ttl must not be negative")
+	}
+	return nil
+}
+
+// Handlers whose decisions depend on only part of the object can implement
+// this interface to return that part, so that unrelated changes (such as to
+// the resourceVersion) don't miss the cache. Handlers whose decisions depend
+// on anything beyond the request, such as the state of the cluster, should
+// return false to never be cached.
+type CacheableHandler interface {
+	AdmissionReviewHandler
+	CacheContent(ar *v1beta1.AdmissionReview) ([]byte, bool)
+}
+
+var (
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "admission_webhook",
+		Name:      "decision_cache_requests_total",
+		Help:      "Lookups in each handler's decision cache, by result.",
+	}, []string{"handler", "result"})
+	cacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "admission_webhook",
+		Name:      "decision_cache_evictions_total",
+		Help:      "Results evicted from each handler's decision cache to make room for others.",
+	}, []string{"handler"})
+)
+
+func init() {
+	prometheus.MustRegister(cacheRequests, cacheEvictions)
+}
+
+type cacheEntry struct {
+	key     [sha256.Size]byte
+	result  AdmissionResult
+	expires time.Time
+}
+
+// An LRU cache of results
+type decisionCache struct {
+	name    string
+	size    int
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+	// overridden in tests
+	now func() time.Time
+}
+
+func newDecisionCache(name string, options CacheOptions) *decisionCache {
+	if options.Size == 0 {
+		options.Size = 1000
+	}
+	if options.TTL == 0 {
+		options.TTL = 5 * time.Minute
+	}
+	return &decisionCache{
+		name:    name,
+		size:    options.Size,
+		ttl:     options.TTL,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// the cache key for the request, or false if it shouldn't be cached
+func cacheKey(handler AdmissionReviewHandler, ar *v1beta1.AdmissionReview) ([sha256.Size]byte, bool) {
+	var content []byte
+	if h, ok := handler.(CacheableHandler); ok {
+		var cacheable bool
+		if content, cacheable = h.CacheContent(ar); !cacheable {
+			return [sha256.Size]byte{}, false
+		}
+	} else {
+		content = append(append(append([]byte{}, ar.Request.Object.Raw...), 0), ar.Request.OldObject.Raw...)
+	}
+
+	groups := append([]string{}, ar.Request.UserInfo.Groups...)
+	sort.Strings(groups)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s\x00%s\x00%q\x00", ar.Request.Resource, ar.Request.SubResource,
+		ar.Request.Operation, ar.Request.Namespace, ar.Request.Kind, groups)
+	hash.Write(content)
+
+	var key [sha256.Size]byte
+	copy(key[:], hash.Sum(nil))
+	return key, true
+}
+
+// a copy of the cached result for the key, if there is one
+func (c *decisionCache) get(key [sha256.Size]byte) (*AdmissionResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		cacheRequests.WithLabelValues(c.name, "miss").Inc()
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if c.now().After(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		cacheRequests.WithLabelValues(c.name, "expired").Inc()
+		return nil, false
+	}
+
+	c.lru.MoveToFront(element)
+	cacheRequests.WithLabelValues(c.name, "hit").Inc()
+	return copyResult(&entry.result), true
+}
+
+func (c *decisionCache) add(key [sha256.Size]byte, result *AdmissionResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := &cacheEntry{key: key, result: *copyResult(result), expires: c.now().Add(c.ttl)}
+	if element, found := c.entries[key]; found {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		cacheEvictions.WithLabelValues(c.name).Inc()
+	}
+}
+
+// copy a result, so that callers adding warnings or rendering messages don't
+// change the cached result
+func copyResult(result *AdmissionResult) *AdmissionResult {
+	c := *result
+	c.Violations = append(Violations(nil), result.Violations...)
+	c.Warnings = append([]string(nil), result.Warnings...)
+	c.Patches = append([]PatchOperation(nil), result.Patches...)
+	return &c
+}
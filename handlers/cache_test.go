@@ -0,0 +1,108 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+// countingHandler denies everything, counting its reviews
+type countingHandler struct {
+	reviews int
+}
+
+func (h *countingHandler) Admit(ar *v1beta1.AdmissionReview) error {
+	h.reviews++
+	return Violations{{Field: "metadata.name", RuleID: "test.counting", Message: "Denied"}}
+}
+
+func TestPolicyCache(t *testing.T) {
+	handler := &countingHandler{}
+	policy := &Policy{Name: "counting", Handler: handler, Enforcement: EnforcementWarn, Cache: &CacheOptions{}}
+
+	for i := 0; i < 3; i++ {
+		result := policy.Review(context.Background(), UnmarshalAR(unannotatedJson))
+		if !result.Allowed || len(result.Violations) != 1 || len(result.Warnings) != 1 {
+			t.Errorf("Expecting the cached result to be warned about once, got %+v", result)
+		}
+	}
+	if handler.reviews != 1 {
+		t.Errorf("Expecting identical requests to be reviewed once, got %d reviews", handler.reviews)
+	}
+
+	policy.Review(context.Background(), UnmarshalAR(annotatedJson))
+	if handler.reviews != 2 {
+		t.Errorf("Expecting a different object to be reviewed, got %d reviews", handler.reviews)
+	}
+
+	// a new policy, as built on reload, starts with an empty cache
+	policy = &Policy{Name: "counting", Handler: handler, Cache: &CacheOptions{}}
+	policy.Review(context.Background(), UnmarshalAR(unannotatedJson))
+	if handler.reviews != 3 {
+		t.Errorf("Expecting a new policy not to share the cache, got %d reviews", handler.reviews)
+	}
+}
+
+func TestCacheKeyContent(t *testing.T) {
+	handler := &GkeServiceAdmissionController{}
+	ar := UnmarshalAR(unannotatedJson)
+	key, cacheable := cacheKey(handler, ar)
+	if !cacheable {
+		t.Fatal("Expecting Services to be cacheable")
+	}
+
+	// the resourceVersion isn't reviewed, so doesn't change the key
+	ar.Request.Object.Raw = []byte(`{"metadata":{"name":"test-service","resourceVersion":"2"},"spec":{"type":"LoadBalancer"}}`)
+	first, _ := cacheKey(handler, ar)
+	ar.Request.Object.Raw = []byte(`{"metadata":{"name":"test-service","resourceVersion":"3"},"spec":{"type":"LoadBalancer"}}`)
+	second, _ := cacheKey(handler, ar)
+	if first != second {
+		t.Error("Expecting irrelevant changes not to change the cache key")
+	}
+
+	ar.Request.UserInfo.Groups = []string{"system:masters"}
+	if third, _ := cacheKey(handler, ar); third == second || third == key {
+		t.Error("Expecting the user's groups to change the cache key")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	now := time.Unix(0, 0)
+	cache := newDecisionCache("test", CacheOptions{Size: 2, TTL: time.Minute})
+	cache.now = func() time.Time { return now }
+
+	keys := [][sha256.Size]byte{{1}, {2}, {3}}
+	cache.add(keys[0], &AdmissionResult{Allowed: true})
+	cache.add(keys[1], &AdmissionResult{Allowed: true})
+	cache.get(keys[0])
+	cache.add(keys[2], &AdmissionResult{Allowed: true})
+
+	if _, found := cache.get(keys[1]); found {
+		t.Error("Expecting the least recently used result to be evicted")
+	}
+	if _, found := cache.get(keys[0]); !found {
+		t.Error("Expecting a recently used result to be kept")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, found := cache.get(keys[0]); found {
+		t.Error("Expecting an expired result to be dropped")
+	}
+}
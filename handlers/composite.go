@@ -0,0 +1,88 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+// Run an ordered list of handlers against each AdmissionReview received on a
+// single path, so that several policies for the same resource only cost the
+// API server one webhook call.
+//
+// The request is decoded once, and every handler is given the same
+// AdmissionReview. Warnings from every handler that runs are returned, and
+// patches from the allowing handlers are concatenated in handler order. Each
+// handler sees the object as submitted, not as patched by earlier handlers.
+
+type CompositeMode int
+
+const (
+	// Every handler is run, and the admission is rejected if any of them
+	// reject it. The messages from every rejecting handler are combined.
+	CompositeAllMustPass CompositeMode = iota
+	// Handlers are run in order until the first rejection, whose message is
+	// returned. Later handlers are not run.
+	CompositeFirstDeny
+	// Every handler is run, but the admission is never rejected: rejections
+	// are returned as warnings instead. Useful for trialling a set of policies
+	// before enforcing them.
+	CompositeCollectAll
+)
+
+type CompositeAdmissionController struct {
+	Mode     CompositeMode
+	Handlers []AdmissionReviewHandler
+}
+
+func (c *CompositeAdmissionController) Admit(ar *v1beta1.AdmissionReview) error {
+	return c.Review(context.Background(), ar).Err()
+}
+
+func (c *CompositeAdmissionController) Review(ctx context.Context, ar *v1beta1.AdmissionReview) *AdmissionResult {
+	merged := &AdmissionResult{Allowed: true}
+	var denials []string
+	var violations Violations
+
+	for _, handler := range c.Handlers {
+		result := reviewWith(ctx, handler, ar)
+		merged.Warnings = append(merged.Warnings, result.Warnings...)
+
+		if result.Allowed {
+			merged.Patches = append(merged.Patches, result.Patches...)
+			continue
+		}
+
+		switch c.Mode {
+		case CompositeFirstDeny:
+			return &AdmissionResult{Allowed: false, Message: result.Message, Violations: result.Violations, Warnings: merged.Warnings}
+		case CompositeCollectAll:
+			merged.Warnings = append(merged.Warnings, result.Message)
+		default:
+			denials = append(denials, result.Message)
+			violations = append(violations, result.Violations...)
+		}
+	}
+
+	if len(denials) > 0 {
+		// patches only apply to allowed objects, so there's no point passing
+		// them back
+		return &AdmissionResult{Allowed: false, Message: strings.Join(denials, "; "), Violations: violations, Warnings: merged.Warnings}
+	}
+	return merged
+}
@@ -0,0 +1,122 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+type resultHandler struct {
+	result AdmissionResult
+	called int
+}
+
+func (h *resultHandler) Admit(ar *v1beta1.AdmissionReview) error {
+	return nil
+}
+
+func (h *resultHandler) Review(ctx context.Context, ar *v1beta1.AdmissionReview) *AdmissionResult {
+	h.called++
+	result := h.result
+	return &result
+}
+
+func compositeAR(t *testing.T) *v1beta1.AdmissionReview {
+	return UnmarshalPromAR(t, validQuery)
+}
+
+func TestCompositeAllowed(t *testing.T) {
+	first := &resultHandler{result: AdmissionResult{Allowed: true, Warnings: []string{"first"}, Patches: []PatchOperation{{Op: "add", Path: "/a", Value: "1"}}}}
+	second := &resultHandler{result: AdmissionResult{Allowed: true, Warnings: []string{"second"}, Patches: []PatchOperation{{Op: "add", Path: "/b", Value: "2"}}}}
+
+	handler := CompositeAdmissionController{Handlers: []AdmissionReviewHandler{first, &testHandler{fail: false}, second}}
+	result := handler.Review(context.Background(), compositeAR(t))
+
+	if !result.Allowed {
+		t.Error("Expecting composite of allowing handlers to be allowed")
+	}
+	if len(result.Warnings) != 2 || result.Warnings[0] != "first" || result.Warnings[1] != "second" {
+		t.Errorf("Expecting warnings to be merged in order, got %v", result.Warnings)
+	}
+	if len(result.Patches) != 2 || result.Patches[0].Path != "/a" || result.Patches[1].Path != "/b" {
+		t.Errorf("Expecting patches to be merged in order, got %v", result.Patches)
+	}
+}
+
+func TestCompositeAllMustPass(t *testing.T) {
+	last := &resultHandler{result: AdmissionResult{Allowed: false, Message: "second failure"}}
+	handler := CompositeAdmissionController{
+		Mode:     CompositeAllMustPass,
+		Handlers: []AdmissionReviewHandler{&testHandler{fail: true}, &resultHandler{result: AdmissionResult{Allowed: true}}, last},
+	}
+
+	result := handler.Review(context.Background(), compositeAR(t))
+	if result.Allowed {
+		t.Error("Expecting composite with a failing handler to be disallowed")
+	}
+	if last.called != 1 {
+		t.Error("Expecting every handler to be run")
+	}
+	if !strings.Contains(result.Message, "Deliberately failing test") || !strings.Contains(result.Message, "second failure") {
+		t.Errorf("Expecting every denial message to be included, got %q", result.Message)
+	}
+	if len(result.Patches) != 0 {
+		t.Error("Expecting no patches to be returned for a denial")
+	}
+}
+
+func TestCompositeFirstDeny(t *testing.T) {
+	last := &resultHandler{result: AdmissionResult{Allowed: false, Message: "second failure"}}
+	handler := CompositeAdmissionController{
+		Mode:     CompositeFirstDeny,
+		Handlers: []AdmissionReviewHandler{&testHandler{fail: true}, last},
+	}
+
+	if err := handler.Admit(compositeAR(t)); err == nil || err.Error() != "Deliberately failing test" {
+		t.Errorf("Expecting only the first denial to be returned, got %v", err)
+	}
+	if last.called != 0 {
+		t.Error("Expecting handlers after the first denial not to be run")
+	}
+}
+
+func TestCompositeCollectAll(t *testing.T) {
+	handler := CompositeAdmissionController{
+		Mode:     CompositeCollectAll,
+		Handlers: []AdmissionReviewHandler{&testHandler{fail: true}, &resultHandler{result: AdmissionResult{Allowed: false, Message: "second failure"}}},
+	}
+
+	result := handler.Review(context.Background(), compositeAR(t))
+	if !result.Allowed {
+		t.Error("Expecting collect-all composite to be allowed")
+	}
+	if len(result.Warnings) != 2 {
+		t.Errorf("Expecting denials to be returned as warnings, got %v", result.Warnings)
+	}
+}
+
+func TestCompositeBuiltinHandlers(t *testing.T) {
+	handler := CompositeAdmissionController{
+		Handlers: []AdmissionReviewHandler{&PrometheusRulesAdmissionController{}, &testHandler{fail: false}},
+	}
+
+	if err := handler.Admit(UnmarshalPromAR(t, invalidQuery)); err == nil {
+		t.Error("Expecting invalid promql to be disallowed by the composite")
+	}
+}
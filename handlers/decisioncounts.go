@@ -0,0 +1,92 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// Counts of a policy's decisions over the last hour, kept in one bucket per
+// minute
+
+type DecisionOutcome string
+
+const (
+	OutcomeAllowed DecisionOutcome = "allowed"
+	OutcomeDenied  DecisionOutcome = "denied"
+	// Would have been denied, but the policy is in warn mode
+	OutcomeWarned DecisionOutcome = "warned"
+	// Would have been denied, but the policy is in dry-run mode
+	OutcomeDryRun DecisionOutcome = "dryrun"
+	OutcomeExempt DecisionOutcome = "exempt"
+	// Not reviewed, as the policy was overloaded
+	OutcomeShed DecisionOutcome = "shed"
+)
+
+const decisionCountWindow = 60
+
+type decisionCountBucket struct {
+	minute int64
+	counts map[DecisionOutcome]uint64
+}
+
+type decisionCounts struct {
+	lock    sync.Mutex
+	buckets [decisionCountWindow]decisionCountBucket
+	// overridden in tests
+	now func() time.Time
+}
+
+func (c *decisionCounts) minute() int64 {
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	return now().Unix() / 60
+}
+
+func (c *decisionCounts) record(outcome DecisionOutcome) {
+	minute := c.minute()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	bucket := &c.buckets[minute%decisionCountWindow]
+	if bucket.minute != minute || bucket.counts == nil {
+		bucket.minute = minute
+		bucket.counts = make(map[DecisionOutcome]uint64)
+	}
+	bucket.counts[outcome]++
+}
+
+// the total of each outcome over the window
+func (c *decisionCounts) totals() map[DecisionOutcome]uint64 {
+	minute := c.minute()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	totals := make(map[DecisionOutcome]uint64)
+	for _, bucket := range c.buckets {
+		if minute-bucket.minute >= decisionCountWindow {
+			continue
+		}
+		for outcome, count := range bucket.counts {
+			totals[outcome] += count
+		}
+	}
+	return totals
+}
@@ -0,0 +1,102 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Every decision made by a Policy is passed to the registered DecisionSinks,
+// e.g. to write an audit log.
+
+type Decision struct {
+	Time        time.Time
+	UID         types.UID
+	Handler     string
+	Resource    metav1.GroupVersionResource
+	SubResource string
+	Kind        string
+	Namespace   string
+	Name        string
+	Operation   v1beta1.Operation
+	User        string
+	Groups      []string
+	Enforcement EnforcementMode
+	Outcome     DecisionOutcome
+	// Whether the object was allowed, after applying the enforcement mode
+	Allowed bool
+	// The handler's message, if it rejected the object
+	Message    string
+	Violations Violations
+	Warnings   []string
+	Latency    time.Duration
+	// The object under review, and the existing object on UPDATE and DELETE
+	Object    json.RawMessage
+	OldObject json.RawMessage
+}
+
+type DecisionSink interface {
+	// Called on the request path for every decision, so should return
+	// quickly. The decision must not be modified.
+	Record(decision *Decision)
+}
+
+var (
+	decisionSinksLock sync.RWMutex
+	decisionSinks     []DecisionSink
+)
+
+func RegisterDecisionSink(sink DecisionSink) {
+	decisionSinksLock.Lock()
+	defer decisionSinksLock.Unlock()
+	decisionSinks = append(decisionSinks, sink)
+}
+
+func recordDecision(decision *Decision) {
+	recentDecisions.record(decision)
+
+	decisionSinksLock.RLock()
+	defer decisionSinksLock.RUnlock()
+
+	for _, sink := range decisionSinks {
+		sink.Record(decision)
+	}
+}
+
+func newDecision(ar *v1beta1.AdmissionReview, policy *Policy) *Decision {
+	meta := objectMeta(ar)
+	return &Decision{
+		Time:        time.Now(),
+		UID:         ar.Request.UID,
+		Handler:     policy.Name,
+		Resource:    ar.Request.Resource,
+		SubResource: ar.Request.SubResource,
+		Kind:        ar.Request.Kind.Kind,
+		Namespace:   meta.Namespace,
+		Name:        meta.Name,
+		Operation:   ar.Request.Operation,
+		User:        ar.Request.UserInfo.Username,
+		Groups:      ar.Request.UserInfo.Groups,
+		Enforcement: policy.enforcement(),
+		Object:      json.RawMessage(ar.Request.Object.Raw),
+		OldObject:   json.RawMessage(ar.Request.OldObject.Raw),
+	}
+}
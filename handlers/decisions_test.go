@@ -0,0 +1,78 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"testing"
+)
+
+type recordingSink struct {
+	decisions []*Decision
+}
+
+func (s *recordingSink) Record(decision *Decision) {
+	s.decisions = append(s.decisions, decision)
+}
+
+func recordDecisions() (*recordingSink, func()) {
+	sink := &recordingSink{}
+	RegisterDecisionSink(sink)
+	return sink, func() {
+		decisionSinksLock.Lock()
+		defer decisionSinksLock.Unlock()
+		decisionSinks = nil
+	}
+}
+
+func TestDecisionRecorded(t *testing.T) {
+	sink, reset := recordDecisions()
+	defer reset()
+
+	policy := &Policy{Name: "gkepublicservice", Handler: &GkeServiceAdmissionController{}, Enforcement: EnforcementDryRun}
+	policy.Admit(UnmarshalAR(unannotatedJson))
+
+	if len(sink.decisions) != 1 {
+		t.Fatalf("Expecting one decision, got %d", len(sink.decisions))
+	}
+	d := sink.decisions[0]
+	if d.Handler != "gkepublicservice" || d.Namespace != "default" || d.Name != "test-service" || d.Kind != "Service" {
+		t.Errorf("Unexpected decision object %+v", d)
+	}
+	if d.UID != "681f0022-306f-11e8-8d4f-b827ebf9752a" || d.Operation != "CREATE" || d.User != "kubernetes-admin" || len(d.Groups) != 2 {
+		t.Errorf("Unexpected decision request %+v", d)
+	}
+	if d.Outcome != OutcomeDryRun || !d.Allowed || d.Enforcement != EnforcementDryRun {
+		t.Errorf("Expecting dry-run decision to be recorded, got %+v", d)
+	}
+	if len(d.Violations) != 1 || d.Message == "" {
+		t.Errorf("Expecting the rejection to be recorded, got %+v", d)
+	}
+	if len(d.Object) == 0 || d.Time.IsZero() {
+		t.Errorf("Expecting object and time to be recorded, got %+v", d)
+	}
+}
+
+func TestDirectlyRegisteredHandlersRecorded(t *testing.T) {
+	sink, reset := recordDecisions()
+	defer reset()
+	defer SetHandlers(NewHandlerSet())
+
+	RegisterHandler("/test", &testHandler{fail: true})
+	serve("/test")
+
+	if len(sink.decisions) != 1 || sink.decisions[0].Handler != "*handlers.testHandler" || sink.decisions[0].Outcome != OutcomeDenied {
+		t.Errorf("Expecting decision for directly registered handler, got %+v", sink.decisions)
+	}
+}
@@ -0,0 +1,137 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/admission/v1beta1"
+)
+
+// Route every AdmissionReview received on a single path to the handlers that
+// have registered an interest in it, so that one ValidatingWebhookConfiguration
+// entry can serve every policy.
+//
+// AdmissionReviews that no handler is interested in are allowed. When more
+// than one handler matches, they are run in registration order as a
+// CompositeAdmissionController with the dispatcher's Mode.
+
+const DispatchPath = "/validate"
+
+// The requests a handler is interested in, following the conventions of the
+// `rules` in a ValidatingWebhookConfiguration: "*" matches any value, and
+// subresources are matched with "resource/subresource", so "pods" does not
+// match "pods/status" but "pods/*", "*/status" and "*/*" do.
+// An empty list matches any value.
+type MatchRule struct {
+	Operations  []v1beta1.Operation `json:"operations,omitempty"`
+	APIGroups   []string            `json:"apiGroups,omitempty"`
+	APIVersions []string            `json:"apiVersions,omitempty"`
+	Resources   []string            `json:"resources,omitempty"`
+}
+
+type dispatchRoute struct {
+	rule    MatchRule
+	handler AdmissionReviewHandler
+}
+
+type DispatchAdmissionController struct {
+	Mode   CompositeMode
+	routes []dispatchRoute
+}
+
+// Register a handler in the active HandlerSet, to be run for every
+// AdmissionReview received on DispatchPath that matches the rule
+func RegisterDispatchHandler(rule MatchRule, handler AdmissionReviewHandler) {
+	updateHandlers(func(set *HandlerSet) {
+		set.RegisterDispatch(rule, handler)
+	})
+}
+
+func (d *DispatchAdmissionController) Register(rule MatchRule, handler AdmissionReviewHandler) {
+	d.routes = append(d.routes, dispatchRoute{rule: rule, handler: handler})
+}
+
+func (d *DispatchAdmissionController) Admit(ar *v1beta1.AdmissionReview) error {
+	return d.Review(context.Background(), ar).Err()
+}
+
+func (d *DispatchAdmissionController) Review(ctx context.Context, ar *v1beta1.AdmissionReview) *AdmissionResult {
+	matching := d.matching(ar.Request)
+	if len(matching) == 0 {
+		level.Debug(LoggerFrom(ctx)).Log("msg", "No handlers registered", "operation", ar.Request.Operation)
+		return &AdmissionResult{Allowed: true}
+	}
+
+	composite := CompositeAdmissionController{Mode: d.Mode, Handlers: matching}
+	return composite.Review(ctx, ar)
+}
+
+func (d *DispatchAdmissionController) matching(request *v1beta1.AdmissionRequest) []AdmissionReviewHandler {
+	var matching []AdmissionReviewHandler
+	for _, route := range d.routes {
+		if route.rule.Matches(request) {
+			matching = append(matching, route.handler)
+		}
+	}
+	return matching
+}
+
+func (r MatchRule) Matches(request *v1beta1.AdmissionRequest) bool {
+	operations := make([]string, len(r.Operations))
+	for i, operation := range r.Operations {
+		operations[i] = string(operation)
+	}
+
+	return matchesAny(operations, string(request.Operation)) &&
+		matchesAny(r.APIGroups, request.Resource.Group) &&
+		matchesAny(r.APIVersions, request.Resource.Version) &&
+		matchesResource(r.Resources, request.Resource.Resource, request.SubResource)
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == "*" || v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesResource(resources []string, resource, subresource string) bool {
+	if len(resources) == 0 {
+		return true
+	}
+	for _, r := range resources {
+		parts := strings.SplitN(r, "/", 2)
+		if parts[0] != "*" && parts[0] != resource {
+			continue
+		}
+		if len(parts) == 1 {
+			// a bare resource (or "*") doesn't match any of its subresources
+			if subresource == "" {
+				return true
+			}
+		} else if parts[1] == "*" || parts[1] == subresource {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func dispatchRequest(operation v1beta1.Operation, resource, subresource string) *v1beta1.AdmissionRequest {
+	return &v1beta1.AdmissionRequest{
+		Operation:   operation,
+		Resource:    metav1.GroupVersionResource{Group: "", Version: "v1", Resource: resource},
+		SubResource: subresource,
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	tests := []struct {
+		rule    MatchRule
+		request *v1beta1.AdmissionRequest
+		matches bool
+	}{
+		{MatchRule{}, dispatchRequest(v1beta1.Create, "pods", "status"), true},
+		{MatchRule{Resources: []string{"services"}}, dispatchRequest(v1beta1.Create, "services", ""), true},
+		{MatchRule{Resources: []string{"services"}}, dispatchRequest(v1beta1.Create, "services", "status"), false},
+		{MatchRule{Resources: []string{"services/*"}}, dispatchRequest(v1beta1.Create, "services", "status"), true},
+		{MatchRule{Resources: []string{"*/status"}}, dispatchRequest(v1beta1.Create, "services", "status"), true},
+		{MatchRule{Resources: []string{"*"}}, dispatchRequest(v1beta1.Create, "services", "status"), false},
+		{MatchRule{Resources: []string{"*/*"}}, dispatchRequest(v1beta1.Create, "services", "status"), true},
+		{MatchRule{Resources: []string{"configmaps"}}, dispatchRequest(v1beta1.Create, "services", ""), false},
+		{MatchRule{Operations: []v1beta1.Operation{v1beta1.Update}}, dispatchRequest(v1beta1.Create, "services", ""), false},
+		{MatchRule{Operations: []v1beta1.Operation{"*"}}, dispatchRequest(v1beta1.Delete, "services", ""), true},
+		{MatchRule{APIGroups: []string{"apps"}}, dispatchRequest(v1beta1.Create, "services", ""), false},
+		{MatchRule{APIVersions: []string{"v1"}}, dispatchRequest(v1beta1.Create, "services", ""), true},
+	}
+
+	for _, test := range tests {
+		if test.rule.Matches(test.request) != test.matches {
+			t.Errorf("Expecting %+v matching %s %s/%s to be %v", test.rule, test.request.Operation, test.request.Resource.Resource, test.request.SubResource, test.matches)
+		}
+	}
+}
+
+func TestDispatchRouting(t *testing.T) {
+	d := DispatchAdmissionController{}
+	d.Register(MatchRule{Resources: []string{"configmaps"}}, &PrometheusRulesAdmissionController{})
+	d.Register(MatchRule{Resources: []string{"services"}}, &GkeServiceAdmissionController{})
+
+	if err := d.Admit(UnmarshalPromAR(t, invalidQuery)); err == nil {
+		t.Error("Expecting invalid promql to be disallowed")
+	}
+	if err := d.Admit(UnmarshalAR(unannotatedJson)); err == nil {
+		t.Error("Expecting un-annotated Service to be disallowed")
+	}
+	if err := d.Admit(UnmarshalAR(annotatedJson)); err != nil {
+		t.Error("Expecting annotated Service to be allowed")
+	}
+}
+
+func TestDispatchUnmatchedAllowed(t *testing.T) {
+	d := DispatchAdmissionController{}
+	d.Register(MatchRule{Resources: []string{"configmaps"}}, &testHandler{fail: true})
+
+	if result := d.Review(context.Background(), UnmarshalAR(unannotatedJson)); !result.Allowed {
+		t.Error("Expecting a resource with no matching handlers to be allowed")
+	}
+}
+
+func TestDispatchAllMatchingHandlersRun(t *testing.T) {
+	d := DispatchAdmissionController{}
+	first := &resultHandler{result: AdmissionResult{Allowed: true}}
+	second := &resultHandler{result: AdmissionResult{Allowed: true}}
+	d.Register(MatchRule{Resources: []string{"services"}}, first)
+	d.Register(MatchRule{Operations: []v1beta1.Operation{v1beta1.Create}}, second)
+
+	d.Review(context.Background(), UnmarshalAR(unannotatedJson))
+	if first.called != 1 || second.called != 1 {
+		t.Error("Expecting every matching handler to be run")
+	}
+}
@@ -0,0 +1,161 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Mutate LoadBalancer Services to default to an internal load balancer
+//
+// A LoadBalancer Service with neither an internal load balancer annotation
+// nor the opt-in annotation is given the internal annotation of the first
+// configured profile (by default, GKE's), rather than being rejected, and the
+// user is warned of the change. Services with either annotation are left for
+// the gkepublicservice handler to review, as are existing LoadBalancer
+// Services, so that an update never silently makes a public load balancer
+// internal.
+//
+// The handler takes the same parameters as the gkepublicservice handler, so
+// that both can be given the same profiles and opt-in annotation.
+
+type GkeInternalServiceMutator struct {
+	GkeServiceAdmissionController `yaml:",inline"`
+}
+
+func init() {
+	RegisterHandlerFactory(HandlerFactory{
+		Name:              "gkeinternalservice",
+		Description:       "Mutating: adds the internal load balancer annotation to LoadBalancer Services with neither it nor the opt-in annotation.",
+		DisabledByDefault: true,
+		Mutating:          true,
+		New:               func() AdmissionReviewHandler { return &GkeInternalServiceMutator{} },
+	})
+}
+
+func (m *GkeInternalServiceMutator) SetParameters(decode func(into interface{}) error) error {
+	if err := m.GkeServiceAdmissionController.SetParameters(decode); err != nil {
+		return err
+	}
+	if _, _, ok := m.injectedAnnotation(); !ok {
+		return fmt.Errorf("no internal annotation to add: configure a profile, or internalAnnotations")
+	}
+	return nil
+}
+
+func (m *GkeInternalServiceMutator) Admit(ar *v1beta1.AdmissionReview) error {
+	return m.Review(context.Background(), ar).Err()
+}
+
+func (m *GkeInternalServiceMutator) Review(ctx context.Context, ar *v1beta1.AdmissionReview) *AdmissionResult {
+	service, err := extractService(ar)
+	if err != nil {
+		return resultFromError(err)
+	}
+	old, err := extractOldService(ar)
+	if err != nil {
+		return resultFromError(err)
+	}
+	return m.defaultInternal(ctx, old, service)
+}
+
+// The loadBalancerQuota is only enforced by the gkepublicservice handler
+func (m *GkeInternalServiceMutator) CountsServices() bool {
+	return false
+}
+
+// The result only depends on the Service's name, annotations and type, and
+// on the type it had before an update
+func (m *GkeInternalServiceMutator) CacheContent(ar *v1beta1.AdmissionReview) ([]byte, bool) {
+	service, err := extractService(ar)
+	if err != nil {
+		return nil, false
+	}
+	old, err := extractOldService(ar)
+	if err != nil {
+		return nil, false
+	}
+	var oldType corev1.ServiceType
+	if old != nil {
+		oldType = old.Spec.Type
+	}
+	return []byte(fmt.Sprintf("%q\x00%s\x00%s\x00%t\x00%q", service.Name, oldType, service.Spec.Type, service.Annotations == nil, m.presentAnnotations(service))), true
+}
+
+// the annotation added to Services, from the first profile or configured
+// internal annotation
+func (m *GkeInternalServiceMutator) injectedAnnotation() (string, string, bool) {
+	for _, a := range m.internalAnnotations() {
+		if len(a.InternalValues) > 0 {
+			return a.Key, a.InternalValues[0], true
+		}
+	}
+	return "", "", false
+}
+
+// the internal and opt-in annotations the Service has
+func (m *GkeInternalServiceMutator) presentAnnotations(service *corev1.Service) []string {
+	var present []string
+	keys := []string{m.optInAnnotation()}
+	for _, a := range m.internalAnnotations() {
+		keys = append(keys, a.Key)
+	}
+	for _, key := range keys {
+		if _, found := service.Annotations[key]; found {
+			present = append(present, key)
+		}
+	}
+	return present
+}
+
+// old is nil unless the request is an update
+func (m *GkeInternalServiceMutator) defaultInternal(ctx context.Context, old, service *corev1.Service) *AdmissionResult {
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer || len(m.presentAnnotations(service)) > 0 {
+		return &AdmissionResult{Allowed: true}
+	}
+	if old != nil && old.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		return &AdmissionResult{Allowed: true}
+	}
+
+	key, value, ok := m.injectedAnnotation()
+	if !ok {
+		return &AdmissionResult{Allowed: true}
+	}
+
+	level.Info(LoggerFrom(ctx)).Log("msg", "Defaulting service to an internal load balancer", "annotation", key)
+	var patch PatchOperation
+	if service.Annotations == nil {
+		patch = PatchOperation{Op: "add", Path: "/metadata/annotations", Value: map[string]string{key: value}}
+	} else {
+		patch = PatchOperation{Op: "add", Path: "/metadata/annotations/" + escapeJSONPointer(key), Value: value}
+	}
+	return &AdmissionResult{
+		Allowed: true,
+		Patches: []PatchOperation{patch},
+		Warnings: []string{fmt.Sprintf("The LoadBalancer service '%s' had no internal or '%s' annotation, so '%s: %s' was added to give it an internal load balancer. To make it public, add the '%s: %s' annotation.",
+			service.Name, m.optInAnnotation(), key, value, m.optInAnnotation(), m.optInValues()[0])},
+	}
+}
+
+// escape a JSON patch path segment (RFC 6901)
+func escapeJSONPointer(segment string) string {
+	return strings.Replace(strings.Replace(segment, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,116 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestDefaultInternal(t *testing.T) {
+	m := &GkeInternalServiceMutator{}
+	result := m.Review(context.Background(), UnmarshalAR(unannotatedJson))
+	if !result.Allowed || len(result.Patches) != 1 || len(result.Warnings) != 1 {
+		t.Fatalf("Expecting the internal annotation to be added with a warning, got %+v", result)
+	}
+	patch, _ := json.Marshal(result.Patches)
+	if string(patch) != `[{"op":"add","path":"/metadata/annotations/cloud.google.com~1load-balancer-type","value":"Internal"}]` {
+		t.Errorf("Unexpected patch %s", patch)
+	}
+	if !strings.Contains(result.Warnings[0], "gke/load-balancer-type: External") {
+		t.Errorf("Expecting the warning to explain how to make the service public, got %s", result.Warnings[0])
+	}
+
+	// services with either annotation are left alone
+	for _, annotations := range []string{`"cloud.google.com/load-balancer-type":"internal"`, `"gke/load-balancer-type":"External"`, `"networking.gke.io/load-balancer-type":"External"`} {
+		result := m.Review(context.Background(), UnmarshalAR(fmt.Sprintf(arJsonFmt, annotations)))
+		if !result.Allowed || len(result.Patches) != 0 || len(result.Warnings) != 0 {
+			t.Errorf("Expecting a service with %s to be unchanged, got %+v", annotations, result)
+		}
+	}
+}
+
+func TestDefaultInternalWithoutAnnotations(t *testing.T) {
+	m := &GkeInternalServiceMutator{}
+	service := UnmarshalService(unannotatedJson)
+	service.Annotations = nil
+	result := m.defaultInternal(context.Background(), nil, service)
+	patch, _ := json.Marshal(result.Patches)
+	if string(patch) != `[{"op":"add","path":"/metadata/annotations","value":{"cloud.google.com/load-balancer-type":"Internal"}}]` {
+		t.Errorf("Unexpected patch %s", patch)
+	}
+
+	service.Spec.Type = "ClusterIP"
+	if result := m.defaultInternal(context.Background(), nil, service); len(result.Patches) != 0 {
+		t.Errorf("Expecting a ClusterIP service to be unchanged, got %+v", result)
+	}
+}
+
+func TestDefaultInternalUpdates(t *testing.T) {
+	m := &GkeInternalServiceMutator{}
+	service := UnmarshalService(unannotatedJson)
+
+	// an existing LoadBalancer is never made internal
+	old := service.DeepCopy()
+	if result := m.Review(context.Background(), updateReview(t, old, service)); !result.Allowed || len(result.Patches) != 0 || len(result.Warnings) != 0 {
+		t.Errorf("Expecting an existing LoadBalancer service to be unchanged, got %+v", result)
+	}
+
+	// a service becoming a LoadBalancer is defaulted, as on creation
+	old.Spec.Type = corev1.ServiceTypeClusterIP
+	if result := m.Review(context.Background(), updateReview(t, old, service)); !result.Allowed || len(result.Patches) != 1 {
+		t.Errorf("Expecting a service becoming a LoadBalancer to be made internal, got %+v", result)
+	}
+}
+
+func TestDefaultInternalCacheContent(t *testing.T) {
+	m := &GkeInternalServiceMutator{}
+	service := UnmarshalService(unannotatedJson)
+	other := service.DeepCopy()
+	other.Name = "other"
+	content, _ := m.CacheContent(updateReview(t, service, service))
+	if otherContent, _ := m.CacheContent(updateReview(t, other, other)); string(content) == string(otherContent) {
+		t.Error("Expecting the service name, which the warning includes, to be part of the cache content")
+	}
+	old := service.DeepCopy()
+	old.Spec.Type = corev1.ServiceTypeClusterIP
+	if updateContent, _ := m.CacheContent(updateReview(t, old, service)); string(content) == string(updateContent) {
+		t.Error("Expecting the old service's type to be part of the cache content")
+	}
+}
+
+func TestDefaultInternalProfiles(t *testing.T) {
+	m := &GkeInternalServiceMutator{}
+	if err := m.SetParameters(yamlDecoder("profiles: [aws, gke]\noptInAnnotation: example.com/public")); err != nil {
+		t.Fatal(err)
+	}
+	result := m.Review(context.Background(), UnmarshalAR(unannotatedJson))
+	if len(result.Patches) != 1 || result.Patches[0].Path != "/metadata/annotations/service.beta.kubernetes.io~1aws-load-balancer-internal" || result.Patches[0].Value != "true" {
+		t.Errorf("Expecting the first profile's annotation to be added, got %+v", result.Patches)
+	}
+	result = m.Review(context.Background(), UnmarshalAR(fmt.Sprintf(arJsonFmt, `"example.com/public":"External"`)))
+	if len(result.Patches) != 0 {
+		t.Errorf("Expecting the configured opt-in annotation to be recognised, got %+v", result.Patches)
+	}
+
+	if err := (&GkeInternalServiceMutator{}).SetParameters(yamlDecoder("profiles: []")); err == nil {
+		t.Error("Expecting parameters without an internal annotation to be refused")
+	}
+}
@@ -15,14 +15,17 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
 
-	"github.com/golang/glog"
+	"github.com/go-kit/kit/log/level"
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
 // Perform the admission logic on the Service object
@@ -38,37 +41,337 @@ import (
 // The annotation that would allow an externally-visible service is:
 //  gke/load-balancer-type: External
 //
+// The annotations and values used, and the namespaces allowed to publish
+// external services, can be changed with the handler's parameters. Profiles
+// recognise the internal load balancer annotations of other cloud providers,
+// so that the same policy can be used on every cluster.
 
-type GkeServiceAdmissionController struct{}
+type GkeServiceAdmissionController struct {
+	// The annotation marking a service as intentionally external. Defaults
+	// to gke/load-balancer-type.
+	OptInAnnotation string `yaml:"optInAnnotation" json:"optInAnnotation,omitempty"`
+	// The values of the opt-in annotation allowing an external service,
+	// compared case-insensitively. Defaults to External.
+	OptInValues []string `yaml:"optInValues" json:"optInValues,omitempty"`
+	// The cloud providers whose internal load balancer annotations are
+	// recognised: gke, aws, azure or metallb. Defaults to gke, unless
+	// internalAnnotations are given.
+	Profiles []string `yaml:"profiles" json:"profiles,omitempty"`
+	// The MetalLB address pools that are internal, for the metallb profile
+	MetalLBInternalPools []string `yaml:"metallbInternalPools" json:"metallbInternalPools,omitempty"`
+	// Annotations marking a load balancer as internal, in addition to those
+	// of the profiles
+	InternalAnnotations []InternalAnnotation `yaml:"internalAnnotations" json:"internalAnnotations,omitempty"`
+	// If given, only services in these namespaces may be external
+	ExternalNamespaces []string `yaml:"externalNamespaces" json:"externalNamespaces,omitempty"`
+	// Govern NodePort services and explicit node ports. nil allows them.
+	NodePorts *NodePortPolicy `yaml:"nodePorts" json:"nodePorts,omitempty"`
+	// Govern spec.externalIPs. nil allows any.
+	ExternalIPs *ExternalIPPolicy `yaml:"externalIPs" json:"externalIPs,omitempty"`
+	// Require source ranges on external load balancers. nil doesn't.
+	SourceRanges *SourceRangePolicy `yaml:"sourceRanges" json:"sourceRanges,omitempty"`
+	// Restrict the ports external load balancers expose. nil doesn't.
+	Ports *PortPolicy `yaml:"ports" json:"ports,omitempty"`
+	// Require the opt-in annotation to carry a signed approval, rather than
+	// one of OptInValues. nil doesn't.
+	Approvals *ApprovalPolicy `yaml:"approvals" json:"approvals,omitempty"`
+	// Limit the external load balancers in each namespace. nil doesn't.
+	LoadBalancerQuota *LoadBalancerQuota `yaml:"loadBalancerQuota" json:"loadBalancerQuota,omitempty"`
+}
+
+// An annotation marking a load balancer as internal
+type InternalAnnotation struct {
+	Key string `yaml:"key" json:"key"`
+	// The values making the load balancer internal, compared
+	// case-insensitively
+	InternalValues []string `yaml:"internalValues" json:"internalValues"`
+	// Other values the annotation may take. If given, any other value is
+	// reported as a mistake.
+	ExternalValues []string `yaml:"externalValues" json:"externalValues,omitempty"`
+}
+
+const defaultOptInAnnotation = "gke/load-balancer-type"
+
+const (
+	ProfileGKE     = "gke"
+	ProfileAWS     = "aws"
+	ProfileAzure   = "azure"
+	ProfileMetalLB = "metallb"
+)
+
+// The internal load balancer annotations of each cloud provider. MetalLB's
+// internal values are the configured pools.
+var profileAnnotations = map[string][]InternalAnnotation{
+	ProfileGKE: {
+		{Key: "cloud.google.com/load-balancer-type", InternalValues: []string{"Internal"}, ExternalValues: []string{"External"}},
+		{Key: "networking.gke.io/load-balancer-type", InternalValues: []string{"Internal"}, ExternalValues: []string{"External"}},
+	},
+	ProfileAWS: {
+		// "0.0.0.0/0" is the legacy internal value
+		{Key: "service.beta.kubernetes.io/aws-load-balancer-internal", InternalValues: []string{"true", "0.0.0.0/0"}, ExternalValues: []string{"false"}},
+		{Key: "service.beta.kubernetes.io/aws-load-balancer-scheme", InternalValues: []string{"internal"}, ExternalValues: []string{"internet-facing"}},
+	},
+	ProfileAzure: {
+		{Key: "service.beta.kubernetes.io/azure-load-balancer-internal", InternalValues: []string{"true"}, ExternalValues: []string{"false"}},
+	},
+	ProfileMetalLB: {
+		{Key: "metallb.universe.tf/address-pool"},
+		{Key: "metallb.io/address-pool"},
+	},
+}
+
+func init() {
+	RegisterHandlerFactory(HandlerFactory{
+		Name:        "gkepublicservice",
+		Description: "Rejects LoadBalancer Services that would be public on GKE (or the configured cloud providers), unless annotated as intentionally external.",
+		DefaultRules: []MatchRule{{
+			Operations:  []v1beta1.Operation{v1beta1.Create, v1beta1.Update},
+			APIGroups:   []string{""},
+			APIVersions: []string{"v1"},
+			Resources:   []string{"services"},
+		}},
+		New: func() AdmissionReviewHandler { return &GkeServiceAdmissionController{} },
+	})
+}
+
+func (g *GkeServiceAdmissionController) SetParameters(decode func(into interface{}) error) error {
+	if err := decode(g); err != nil {
+		return err
+	}
+
+	for _, profile := range g.Profiles {
+		if _, found := profileAnnotations[profile]; !found {
+			return fmt.Errorf("unknown profile '%s', expecting one of '%s', '%s', '%s' or '%s'", profile, ProfileGKE, ProfileAWS, ProfileAzure, ProfileMetalLB)
+		}
+	}
+	if contains(g.Profiles, ProfileMetalLB) && len(g.MetalLBInternalPools) == 0 {
+		return fmt.Errorf("metallbInternalPools are required for the metallb profile")
+	}
+
+	for i, a := range g.InternalAnnotations {
+		if len(validation.IsQualifiedName(a.Key)) > 0 {
+			return fmt.Errorf("internalAnnotations[%d]: invalid annotation key '%s'", i, a.Key)
+		}
+		if len(a.InternalValues) == 0 {
+			return fmt.Errorf("internalAnnotations[%d]: internalValues are required", i)
+		}
+	}
+	if g.OptInAnnotation != "" && len(validation.IsQualifiedName(g.OptInAnnotation)) > 0 {
+		return fmt.Errorf("invalid optInAnnotation '%s'", g.OptInAnnotation)
+	}
+	for _, ns := range g.ExternalNamespaces {
+		if len(validation.IsDNS1123Label(ns)) > 0 {
+			return fmt.Errorf("invalid externalNamespaces entry '%s'", ns)
+		}
+	}
+	if g.NodePorts != nil {
+		if err := g.NodePorts.validate(); err != nil {
+			return fmt.Errorf("nodePorts: %v", err)
+		}
+	}
+	if g.ExternalIPs != nil {
+		if err := g.ExternalIPs.validate(); err != nil {
+			return fmt.Errorf("externalIPs: %v", err)
+		}
+	}
+	if g.Ports != nil {
+		if err := g.Ports.validate(); err != nil {
+			return fmt.Errorf("ports: %v", err)
+		}
+	}
+	if g.LoadBalancerQuota != nil {
+		if err := g.LoadBalancerQuota.validate(); err != nil {
+			return fmt.Errorf("loadBalancerQuota: %v", err)
+		}
+	}
+	if g.Approvals != nil {
+		if err := g.Approvals.load(); err != nil {
+			return fmt.Errorf("approvals: %v", err)
+		}
+	}
+	if g.SourceRanges != nil && g.SourceRanges.JustificationAnnotation != "" && len(validation.IsQualifiedName(g.SourceRanges.JustificationAnnotation)) > 0 {
+		return fmt.Errorf("sourceRanges: invalid justificationAnnotation '%s'", g.SourceRanges.JustificationAnnotation)
+	}
+	return nil
+}
 
 func (g *GkeServiceAdmissionController) Admit(ar *v1beta1.AdmissionReview) error {
+	return g.Review(context.Background(), ar).Err()
+}
+
+func (g *GkeServiceAdmissionController) Review(ctx context.Context, ar *v1beta1.AdmissionReview) *AdmissionResult {
 	service, err := extractService(ar)
 	if err != nil {
-		return err
+		return resultFromError(err)
+	}
+	old, err := extractOldService(ar)
+	if err != nil {
+		return resultFromError(err)
+	}
+	for _, s := range []*corev1.Service{service, old} {
+		if s != nil && s.Namespace == "" {
+			s.Namespace = ar.Request.Namespace
+		}
 	}
 
-	return admitService(service)
+	level.Debug(LoggerFrom(ctx)).Log("msg", "Reviewing service", "type", service.Spec.Type)
+	return resultFromError(g.admitUpdate(ctx, old, service))
 }
 
-func admitService(service *corev1.Service) error {
-	const annotation = "gke/load-balancer-type"
+// Only the Service's name, annotations and spec, and those of the existing
+// object on UPDATE, are reviewed. Approvals expire, and quotas depend on the
+// other Services in the namespace, so decisions aren't cached when either is
+// configured.
+func (g *GkeServiceAdmissionController) CacheContent(ar *v1beta1.AdmissionReview) ([]byte, bool) {
+	if g.Approvals != nil || g.LoadBalancerQuota != nil {
+		return nil, false
+	}
+	service, err := extractService(ar)
+	if err != nil {
+		return nil, false
+	}
+	old, err := extractOldService(ar)
+	if err != nil {
+		return nil, false
+	}
 
-	glog.V(2).Infof("Service type %s", service.Spec.Type)
+	reviewed := []interface{}{service.Name, service.Annotations, service.Spec}
+	if old != nil {
+		reviewed = append(reviewed, old.Annotations, old.Spec)
+	}
+	content, err := json.Marshal(reviewed)
+	return content, err == nil
+}
 
-	// in GKE, only LoadBalancer services could be visible externally by default
-	if service.Spec.Type == "LoadBalancer" {
-		// verify that the service has the google annotation, and is set to be internal-only
-		if v, found := service.Annotations["cloud.google.com/load-balancer-type"]; !(found && strings.EqualFold(v, "internal")) {
-			// if it's not internal, or has no google annotation, verify that
-			// our annotation is included to mark the service as external
-			if v, found := service.Annotations[annotation]; !(found && strings.EqualFold(v, "external")) {
-				return fmt.Errorf("The service '%s' is public, and so disallowed without the explicit '%s' annotation.", service.Name, annotation)
+func (g *GkeServiceAdmissionController) optInAnnotation() string {
+	if g.OptInAnnotation == "" {
+		return defaultOptInAnnotation
+	}
+	return g.OptInAnnotation
+}
+
+func (g *GkeServiceAdmissionController) optInValues() []string {
+	if len(g.OptInValues) == 0 {
+		return []string{"External"}
+	}
+	return g.OptInValues
+}
+
+func (g *GkeServiceAdmissionController) internalAnnotations() []InternalAnnotation {
+	profiles := g.Profiles
+	if profiles == nil && g.InternalAnnotations == nil {
+		profiles = []string{ProfileGKE}
+	}
+
+	var annotations []InternalAnnotation
+	for _, profile := range profiles {
+		for _, a := range profileAnnotations[profile] {
+			if profile == ProfileMetalLB {
+				a.InternalValues = g.MetalLBInternalPools
 			}
+			annotations = append(annotations, a)
 		}
 	}
+	return append(annotations, g.InternalAnnotations...)
+}
+
+func (g *GkeServiceAdmissionController) admitService(service *corev1.Service) error {
+	var violations Violations
+	violations = append(violations, g.admitLoadBalancer(service)...)
+	violations = append(violations, g.admitNodePorts(service)...)
+	violations = append(violations, g.admitExternalIPs(service)...)
+	violations = append(violations, g.admitSourceRanges(service)...)
+	violations = append(violations, g.admitPorts(service)...)
+
+	if len(violations) > 0 {
+		return violations
+	}
 	return nil
 }
 
+func (g *GkeServiceAdmissionController) admitLoadBalancer(service *corev1.Service) Violations {
+	// in GKE, only LoadBalancer services could be visible externally by default
+	if service.Spec.Type != "LoadBalancer" {
+		return nil
+	}
+
+	// verify whether the service has an annotation marking it as internal-only
+	if g.internal(service) {
+		return nil
+	}
+
+	annotations := field.NewPath("metadata", "annotations")
+	annotation := g.optInAnnotation()
+	if len(g.ExternalNamespaces) > 0 && !contains(g.ExternalNamespaces, service.Namespace) {
+		return Violations{{
+			Field:   annotations.String(),
+			RuleID:  "gkepublicservice.namespace",
+			Message: fmt.Sprintf("The service '%s' is public, and services in namespace '%s' may not be public.", service.Name, service.Namespace),
+		}}
+	}
+
+	// if it's not internal, verify that our annotation is included to mark
+	// the service as external
+	v, found := service.Annotations[annotation]
+	if found && g.Approvals != nil {
+		if err := g.Approvals.verify(service, v); err != nil {
+			return Violations{{
+				Field:   annotations.Key(annotation).String(),
+				RuleID:  "gkepublicservice.approval",
+				Message: fmt.Sprintf("The service '%s' is public, and the '%s' annotation must be a valid approval: %v.", service.Name, annotation, err),
+			}}
+		}
+		return nil
+	}
+	if found && containsFold(g.optInValues(), v) {
+		return nil
+	}
+
+	var violations Violations
+	if found {
+		violations = append(violations, Violation{
+			Field:   annotations.Key(annotation).String(),
+			RuleID:  "gkepublicservice.opt-in-value",
+			Message: fmt.Sprintf("The service '%s' is public, and the '%s' annotation must be '%s' to allow it, not '%s'.", service.Name, annotation, strings.Join(g.optInValues(), "' or '"), v),
+		})
+	} else {
+		violations = append(violations, Violation{
+			Field:   annotations.Key(annotation).String(),
+			RuleID:  "gkepublicservice.opt-in",
+			Message: fmt.Sprintf("The service '%s' is public, and so disallowed without the explicit '%s' annotation.", service.Name, annotation),
+		})
+	}
+	for _, a := range g.internalAnnotations() {
+		if v, found := service.Annotations[a.Key]; found && len(a.ExternalValues) > 0 && !containsFold(a.ExternalValues, v) {
+			violations = append(violations, Violation{
+				Field:   annotations.Key(a.Key).String(),
+				RuleID:  "gkepublicservice.internal-value",
+				Message: fmt.Sprintf("The '%s' annotation on service '%s' must be '%s' for an internal load balancer, not '%s'.", a.Key, service.Name, strings.Join(a.InternalValues, "' or '"), v),
+			})
+		}
+	}
+	return violations
+}
+
+// whether the service has an annotation marking its load balancer as internal
+func (g *GkeServiceAdmissionController) internal(service *corev1.Service) bool {
+	for _, a := range g.internalAnnotations() {
+		if v, found := service.Annotations[a.Key]; found && containsFold(a.InternalValues, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
 // fetch the actual Service object out of the AdmissionReview
 func extractService(ar *v1beta1.AdmissionReview) (*corev1.Service, error) {
 	// verify that we received a Service object
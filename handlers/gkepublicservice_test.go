@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"testing"
 
+	"gopkg.in/yaml.v2"
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 )
@@ -28,6 +29,8 @@ var arJsonFmt string = `{"kind":"AdmissionReview","request":{"kind":{"kind":"Ser
 var unannotatedJson string = fmt.Sprintf(arJsonFmt, "")
 var annotatedJson string = fmt.Sprintf(arJsonFmt, `"cloud.google.com/load-balancer-type":"internal"`)
 
+var defaultServicePolicy = &GkeServiceAdmissionController{}
+
 func UnmarshalAR(arJson string) *v1beta1.AdmissionReview {
 	ar := v1beta1.AdmissionReview{}
 	json.Unmarshal([]byte(arJson), &ar)
@@ -61,7 +64,7 @@ func TestAllowAnnotatedAR(t *testing.T) {
 func TestDisallowExternalService(t *testing.T) {
 	service := UnmarshalService(unannotatedJson)
 
-	if err := admitService(service); err == nil {
+	if err := defaultServicePolicy.admitService(service); err == nil {
 		t.Error("Expecting un-annotated Service to be disallowed")
 	}
 }
@@ -70,7 +73,7 @@ func TestAllowInternalService(t *testing.T) {
 	service := UnmarshalService(unannotatedJson)
 	service.Annotations["cloud.google.com/load-balancer-type"] = "internal"
 
-	if err := admitService(service); err != nil {
+	if err := defaultServicePolicy.admitService(service); err != nil {
 		t.Error("Expecting annotated Service to be allowed")
 	}
 }
@@ -80,7 +83,7 @@ func TestAllowNonLBService(t *testing.T) {
 	service.Annotations = nil
 	service.Spec.Type = "ClusterIP"
 
-	if err := admitService(service); err != nil {
+	if err := defaultServicePolicy.admitService(service); err != nil {
 		t.Error("Expecting ClusterIP Service to be allowed")
 	}
 }
@@ -89,7 +92,7 @@ func TestAllowExternalServiceWithOurAnnotation(t *testing.T) {
 	service := UnmarshalService(unannotatedJson)
 	service.Annotations["gke/load-balancer-type"] = "external"
 
-	if err := admitService(service); err != nil {
+	if err := defaultServicePolicy.admitService(service); err != nil {
 		t.Error("Expecting annotated Service to be allowed")
 	}
 }
@@ -99,7 +102,7 @@ func TestAllowExternalServiceWithBothAnnotations(t *testing.T) {
 	service.Annotations["cloud.google.com/load-balancer-type"] = "external"
 	service.Annotations["gke/load-balancer-type"] = "external"
 
-	if err := admitService(service); err != nil {
+	if err := defaultServicePolicy.admitService(service); err != nil {
 		t.Error("Expecting annotated Service to be allowed")
 	}
 }
@@ -109,7 +112,151 @@ func TestDisallowExternalServiceWithSwappedAnnotations(t *testing.T) {
 	service.Annotations["cloud.google.com/load-balancer-type"] = "external"
 	service.Annotations["gke/load-balancer-type"] = "internal"
 
-	if err := admitService(service); err == nil {
+	if err := defaultServicePolicy.admitService(service); err == nil {
 		t.Error("Expecting external Service to be disallowed")
 	}
 }
+
+func TestServiceViolations(t *testing.T) {
+	service := UnmarshalService(unannotatedJson)
+	service.Annotations["cloud.google.com/load-balancer-type"] = "internl"
+	service.Annotations["gke/load-balancer-type"] = "public"
+
+	violations, ok := defaultServicePolicy.admitService(service).(Violations)
+	if !ok || len(violations) != 2 {
+		t.Fatalf("Expecting both invalid annotations to be reported, got %v", violations)
+	}
+	if violations[0].RuleID != "gkepublicservice.opt-in-value" || violations[0].Field != "metadata.annotations[gke/load-balancer-type]" {
+		t.Errorf("Unexpected violation %+v", violations[0])
+	}
+	if violations[1].RuleID != "gkepublicservice.internal-value" || violations[1].Field != "metadata.annotations[cloud.google.com/load-balancer-type]" {
+		t.Errorf("Unexpected violation %+v", violations[1])
+	}
+}
+
+// decode parameters as the configuration file does
+func yamlDecoder(parameters string) func(into interface{}) error {
+	return func(into interface{}) error {
+		return yaml.UnmarshalStrict([]byte(parameters), into)
+	}
+}
+
+func serviceParameters(t *testing.T, parameters string) *GkeServiceAdmissionController {
+	g := &GkeServiceAdmissionController{}
+	if err := g.SetParameters(yamlDecoder(parameters)); err != nil {
+		t.Fatalf("Unexpected error setting parameters: %v", err)
+	}
+	return g
+}
+
+func TestConfiguredAnnotations(t *testing.T) {
+	g := serviceParameters(t, `
+optInAnnotation: example.com/public
+optInValues: ["yes", "true"]
+internalAnnotations:
+  - key: example.com/internal
+    internalValues: ["true"]
+`)
+
+	service := UnmarshalService(unannotatedJson)
+	service.Annotations["example.com/public"] = "Yes"
+	if err := g.admitService(service); err != nil {
+		t.Errorf("Expecting the configured opt-in to be allowed, got %v", err)
+	}
+
+	service = UnmarshalService(unannotatedJson)
+	service.Annotations["example.com/internal"] = "true"
+	if err := g.admitService(service); err != nil {
+		t.Errorf("Expecting the configured internal annotation to be allowed, got %v", err)
+	}
+
+	service = UnmarshalService(annotatedJson)
+	service.Annotations["gke/load-balancer-type"] = "external"
+	violations, ok := g.admitService(service).(Violations)
+	if !ok || len(violations) != 1 || violations[0].Field != "metadata.annotations[example.com/public]" {
+		t.Errorf("Expecting the default annotations to be ignored, got %v", violations)
+	}
+}
+
+func TestExternalNamespaces(t *testing.T) {
+	g := serviceParameters(t, `externalNamespaces: [ingress]`)
+
+	service := UnmarshalService(unannotatedJson)
+	service.Annotations["gke/load-balancer-type"] = "external"
+	violations, ok := g.admitService(service).(Violations)
+	if !ok || len(violations) != 1 || violations[0].RuleID != "gkepublicservice.namespace" {
+		t.Errorf("Expecting an external service outside the allowed namespaces to be disallowed, got %v", violations)
+	}
+
+	service.Namespace = "ingress"
+	if err := g.admitService(service); err != nil {
+		t.Errorf("Expecting an external service in an allowed namespace to be allowed, got %v", err)
+	}
+
+	service = UnmarshalService(annotatedJson)
+	if err := g.admitService(service); err != nil {
+		t.Errorf("Expecting an internal service to be allowed in any namespace, got %v", err)
+	}
+}
+
+func TestInvalidParameters(t *testing.T) {
+	for _, parameters := range []string{
+		`internalAnnotations: [{key: "not a key", internalValues: ["true"]}]`,
+		`internalAnnotations: [{key: example.com/internal}]`,
+		`externalNamespaces: [Not_A_Namespace]`,
+		`unknown: true`,
+	} {
+		g := &GkeServiceAdmissionController{}
+		if err := g.SetParameters(yamlDecoder(parameters)); err == nil {
+			t.Errorf("Expecting parameters %s to be refused", parameters)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	g := serviceParameters(t, `
+profiles: [gke, aws, azure, metallb]
+metallbInternalPools: [private]
+`)
+
+	for _, annotation := range []struct{ key, value string }{
+		{"networking.gke.io/load-balancer-type", "Internal"},
+		{"service.beta.kubernetes.io/aws-load-balancer-internal", "true"},
+		{"service.beta.kubernetes.io/aws-load-balancer-scheme", "internal"},
+		{"service.beta.kubernetes.io/azure-load-balancer-internal", "true"},
+		{"metallb.universe.tf/address-pool", "private"},
+	} {
+		service := UnmarshalService(unannotatedJson)
+		service.Annotations[annotation.key] = annotation.value
+		if err := g.admitService(service); err != nil {
+			t.Errorf("Expecting %s: %s to be internal, got %v", annotation.key, annotation.value, err)
+		}
+	}
+
+	service := UnmarshalService(unannotatedJson)
+	service.Annotations["metallb.universe.tf/address-pool"] = "public"
+	service.Annotations["service.beta.kubernetes.io/aws-load-balancer-scheme"] = "internet-facing"
+	violations, ok := g.admitService(service).(Violations)
+	if !ok || len(violations) != 1 || violations[0].RuleID != "gkepublicservice.opt-in" {
+		t.Errorf("Expecting an external pool and scheme to need the opt-in, got %v", violations)
+	}
+
+	// only the selected profiles are recognised
+	g = serviceParameters(t, `profiles: [aws]`)
+	service = UnmarshalService(annotatedJson)
+	if err := g.admitService(service); err == nil {
+		t.Error("Expecting the GKE annotation to be ignored with only the aws profile")
+	}
+}
+
+func TestProfileParameters(t *testing.T) {
+	for _, parameters := range []string{
+		`profiles: [openstack]`,
+		`profiles: [metallb]`,
+	} {
+		g := &GkeServiceAdmissionController{}
+		if err := g.SetParameters(yamlDecoder(parameters)); err == nil {
+			t.Errorf("Expecting parameters %s to be refused", parameters)
+		}
+	}
+}
@@ -15,12 +15,16 @@
 package handlers
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 
-	"github.com/golang/glog"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/api/admission/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -36,77 +40,277 @@ type AdmissionReviewHandler interface {
 	Admit(ar *v1beta1.AdmissionReview) error
 }
 
-type AdmissionReviewHandlerFuncs map[string]http.HandlerFunc
+// Handlers that need to pass back more than an allow/deny decision (warnings
+// or JSON patches) can implement this interface as well. When present, Review
+// is called in preference to Admit.
+type AdmissionReviewResultHandler interface {
+	AdmissionReviewHandler
+	Review(ctx context.Context, ar *v1beta1.AdmissionReview) *AdmissionResult
+}
 
-var (
-	handlerFuncs AdmissionReviewHandlerFuncs
-)
+// The outcome of reviewing a single AdmissionReview
+type AdmissionResult struct {
+	Allowed bool
+	// Displayed to the user when the admission is rejected
+	Message string
+	// The individual reasons for rejecting the admission, if the handler
+	// provided them
+	Violations Violations
+	// Returned to the API server alongside the decision, whether or not the
+	// admission was allowed
+	Warnings []string
+	// Applied to the object by the API server when the admission is allowed
+	// (mutating webhooks only)
+	Patches []PatchOperation
+}
+
+// The error equivalent of the result, for handlers that implement Admit in
+// terms of Review
+func (r *AdmissionResult) Err() error {
+	if r.Allowed {
+		return nil
+	}
+	if len(r.Violations) > 0 && r.Message == r.Violations.Error() {
+		return r.Violations
+	}
+	return errors.New(r.Message)
+}
 
-func init() {
-	handlerFuncs = make(AdmissionReviewHandlerFuncs)
+// A single RFC 6902 JSON Patch operation
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
 }
 
+// The vendored v1beta1.AdmissionResponse predates the warnings field, which
+// API servers from 1.19 onwards will display to the user
+type admissionResponse struct {
+	*v1beta1.AdmissionResponse
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type admissionReviewResponse struct {
+	metav1.TypeMeta `json:",inline"`
+	Response        admissionResponse `json:"response"`
+}
+
+type AdmissionReviewHandlerFuncs map[string]http.HandlerFunc
+
+// Add a handler to the active HandlerSet
 func RegisterHandler(url string, handler AdmissionReviewHandler) {
-	handlerFuncs[url] = func(w http.ResponseWriter, r *http.Request) {
-		handleRequest(w, r, handler)
-	}
+	updateHandlers(func(set *HandlerSet) {
+		set.Register(url, handler)
+	})
 }
 
 func GetRegisteredHandlers() AdmissionReviewHandlerFuncs {
+	handlerFuncs := make(AdmissionReviewHandlerFuncs)
+	for url, handler := range currentHandlers().handlers {
+		handler := handler
+		handlerFuncs[url] = func(w http.ResponseWriter, r *http.Request) {
+			handleRequest(w, r, handler)
+		}
+	}
 	return handlerFuncs
 }
 
+// route the request to the handler for its path in the active HandlerSet
+func serveAdmission(w http.ResponseWriter, r *http.Request) {
+	set := currentHandlers()
+	handler, found := set.handlers[r.URL.Path]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	handleRequest(w, r.WithContext(withMessageTemplates(r.Context(), set.messages)), handler)
+}
+
 func handleRequest(w http.ResponseWriter, r *http.Request, handler AdmissionReviewHandler) {
+	logger := log.With(baseLogger(), "path", r.URL.Path)
+
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		glog.Error(err)
+		level.Error(logger).Log("msg", "Unable to read request", "err", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	glog.V(2).Info("AdmissionReview request", string(data))
+	level.Debug(logger).Log("msg", "AdmissionReview request", "body", string(data))
 
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
-		glog.Errorf("contentType=%s, expect application/json", contentType)
+		level.Error(logger).Log("msg", "Unexpected content type, expecting application/json", "contentType", contentType)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	ar := v1beta1.AdmissionReview{}
 	if err := json.Unmarshal(data, &ar); err != nil {
-		glog.Error(err)
+		level.Error(logger).Log("msg", "Unable to decode AdmissionReview", "err", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-
-	review := v1beta1.AdmissionReview{Response: &v1beta1.AdmissionResponse{Allowed: true, UID: ar.Request.UID}}
-
-	if err := handler.Admit(&ar); err != nil {
-		review.Response.Allowed = false
-		review.Response.Result = &metav1.Status{Message: err.Error()}
+	if ar.Request == nil {
+		level.Error(logger).Log("msg", "AdmissionReview contains no request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	resp, err := json.Marshal(review)
+	logger = requestLogger(logger, &ar)
+	ctx := WithLogger(r.Context(), logger)
+	result := reviewWith(ctx, handler, &ar)
+	level.Debug(logger).Log("msg", "Reviewed request", "allowed", result.Allowed, "message", result.Message)
+
+	resp, err := json.Marshal(buildResponse(ctx, &ar, result))
 	if err != nil {
-		glog.Error(err)
+		level.Error(logger).Log("msg", "Unable to encode AdmissionReview response", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write(resp); err != nil {
-		glog.Error(err)
+		level.Error(logger).Log("msg", "Unable to write response", "err", err)
+	}
+}
+
+// run a single handler against the AdmissionReview, regardless of which of
+// the handler interfaces it implements
+func reviewWith(ctx context.Context, handler AdmissionReviewHandler, ar *v1beta1.AdmissionReview) *AdmissionResult {
+	return renderResult(ctx, ar, runHandler(ctx, handler, ar))
+}
+
+// run the handler, without rendering the messages of any violations
+func runHandler(ctx context.Context, handler AdmissionReviewHandler, ar *v1beta1.AdmissionReview) *AdmissionResult {
+	var result *AdmissionResult
+	if h, ok := handler.(AdmissionReviewResultHandler); ok {
+		result = h.Review(ctx, ar)
+	} else {
+		result = resultFromError(handler.Admit(ar))
+	}
+
+	if result == nil {
+		return &AdmissionResult{Allowed: true}
+	}
+	return result
+}
+
+// render the messages of the result's violations with the configured
+// message templates
+func renderResult(ctx context.Context, ar *v1beta1.AdmissionReview, result *AdmissionResult) *AdmissionResult {
+	if len(result.Violations) > 0 {
+		fromViolations := result.Message == result.Violations.Error()
+		result.Violations = renderViolations(ctx, ar, result.Violations)
+		if fromViolations {
+			result.Message = result.Violations.Error()
+		}
+	}
+	return result
+}
+
+// convert the error returned by Admit into a result, for handlers that
+// implement Review on top of an Admit-style check
+func resultFromError(err error) *AdmissionResult {
+	if violations, ok := err.(Violations); ok {
+		if len(violations) == 0 {
+			return &AdmissionResult{Allowed: true}
+		}
+		return &AdmissionResult{Allowed: false, Message: violations.Error(), Violations: violations}
+	}
+	if err != nil {
+		return &AdmissionResult{Allowed: false, Message: err.Error()}
+	}
+	return &AdmissionResult{Allowed: true}
+}
+
+// fetch the metadata of the object under review. The request's Name isn't
+// always populated on CREATE, so this decodes the object (or the old object,
+// for a DELETE) instead.
+func objectMeta(ar *v1beta1.AdmissionReview) metav1.ObjectMeta {
+	object := struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}{}
+
+	raw := ar.Request.Object.Raw
+	if len(raw) == 0 {
+		raw = ar.Request.OldObject.Raw
 	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &object); err != nil {
+			level.Debug(baseLogger()).Log("msg", "Unable to decode object metadata", "uid", ar.Request.UID, "err", err)
+		}
+	}
+
+	if object.Metadata.Name == "" {
+		object.Metadata.Name = ar.Request.Name
+	}
+	if object.Metadata.Namespace == "" {
+		object.Metadata.Namespace = ar.Request.Namespace
+	}
+	return object.Metadata
+}
+
+// convert the result of a review into the AdmissionReview response expected
+// by the API server
+func buildResponse(ctx context.Context, ar *v1beta1.AdmissionReview, result *AdmissionResult) *admissionReviewResponse {
+	response := &v1beta1.AdmissionResponse{Allowed: result.Allowed, UID: ar.Request.UID}
+
+	if !result.Allowed {
+		response.Result = &metav1.Status{Message: result.Message}
+		if len(result.Violations) > 0 {
+			response.Result.Details = &metav1.StatusDetails{
+				Name:   objectMeta(ar).Name,
+				Kind:   ar.Request.Kind.Kind,
+				Causes: result.Violations.causes(),
+			}
+		}
+	} else if len(result.Patches) > 0 {
+		patch, err := json.Marshal(result.Patches)
+		if err != nil {
+			// a patch we can't serialise can't be applied, so refuse the object
+			level.Error(LoggerFrom(ctx)).Log("msg", "Unable to encode patch", "err", err)
+			response.Allowed = false
+			response.Result = &metav1.Status{Message: "Unable to build the patch for this object"}
+		} else {
+			patchType := v1beta1.PatchTypeJSONPatch
+			response.Patch = patch
+			response.PatchType = &patchType
+		}
+	}
+
+	return &admissionReviewResponse{
+		TypeMeta: ar.TypeMeta,
+		Response: admissionResponse{AdmissionResponse: response, Warnings: result.Warnings},
+	}
+}
+
+// The path Prometheus metrics are served on
+const MetricsPath = "/metrics"
+
+// Whether the path is served by the server itself, and so can't be used by
+// a handler
+func ReservedPath(path string) bool {
+	switch path {
+	case DispatchPath, MetricsPath, PoliciesPath, RecentDecisionsPath:
+		return true
+	}
+	return false
 }
 
 func GetServer(address string) *http.Server {
-	for url, handler := range handlerFuncs {
-		glog.Infof("Setting handler func for %s", url)
-		http.HandleFunc(url, handler)
+	for _, url := range currentHandlers().Paths() {
+		level.Info(baseLogger()).Log("msg", "Setting handler func", "path", url)
 	}
 
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveAdmission)
+	mux.Handle(MetricsPath, prometheus.Handler())
+	mux.HandleFunc(PoliciesPath, requireAdmin(servePolicies))
+	mux.HandleFunc(RecentDecisionsPath, requireAdmin(serveRecentDecisions))
+
 	s := http.Server{
-		Addr: address,
+		Addr:    address,
+		Handler: mux,
 		TLSConfig: &tls.Config{
 			ClientAuth: tls.NoClientCert,
 		},
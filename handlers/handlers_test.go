@@ -15,6 +15,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -30,6 +31,14 @@ var (
 	review string = `{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1beta1","request":{"uid":"d7e11614-4512-11e8-8d4f-b827ebf9752a","kind":{"group":"","version":"v1","kind":"ConfigMap"},"resource":{"group":"","version":"v1","resource":"configmaps"},"namespace":"default","operation":"CREATE","userInfo":{"username":"kubernetes-admin","groups":["system:masters","system:authenticated"]},"object":{"metadata":{"name":"test-rules","namespace":"default","uid":"d7e0f812-4512-11e8-8d4f-b827ebf9752a","creationTimestamp":"2018-04-21T03:19:46Z","labels":""},"data":{"test.rules":""}},"oldObject":null}}`
 )
 
+type violationsHandler struct {
+	violations Violations
+}
+
+func (h *violationsHandler) Admit(ar *v1beta1.AdmissionReview) error {
+	return h.violations
+}
+
 type testHandler struct {
 	fail bool
 }
@@ -118,3 +127,79 @@ func TestSuccess(t *testing.T) {
 		t.Error("Expecting review request to be allowed")
 	}
 }
+
+func TestWarningsAndPatches(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(review))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	handler := &resultHandler{result: AdmissionResult{
+		Allowed:  true,
+		Warnings: []string{"test warning"},
+		Patches:  []PatchOperation{{Op: "add", Path: "/metadata/labels/test", Value: "true"}},
+	}}
+	handleRequest(w, req, handler)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	reviewResponse := struct {
+		Response struct {
+			v1beta1.AdmissionResponse
+			Warnings []string `json:"warnings"`
+		} `json:"response"`
+	}{}
+	if err := json.Unmarshal(body, &reviewResponse); err != nil {
+		t.Errorf("Unable to unmarshal response: %v", err)
+	}
+
+	if !reviewResponse.Response.Allowed {
+		t.Error("Expecting review request to be allowed")
+	}
+	if len(reviewResponse.Response.Warnings) != 1 {
+		t.Error("Expecting warning to be returned")
+	}
+	if reviewResponse.Response.PatchType == nil || *reviewResponse.Response.PatchType != v1beta1.PatchTypeJSONPatch {
+		t.Error("Expecting JSONPatch patch type")
+	}
+	if string(reviewResponse.Response.Patch) != `[{"op":"add","path":"/metadata/labels/test","value":"true"}]` {
+		t.Errorf("Unexpected patch %s", reviewResponse.Response.Patch)
+	}
+}
+
+func TestViolationCauses(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(review))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	handleRequest(w, req, &violationsHandler{Violations{
+		{Field: "data[a]", RuleID: "test.a", Message: "first problem"},
+		{Field: "data[b]", RuleID: "test.b", Message: "second problem"},
+	}})
+
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	reviewResponse := v1beta1.AdmissionReview{}
+	if err := json.Unmarshal(body, &reviewResponse); err != nil {
+		t.Errorf("Unable to unmarshal response: %v", err)
+	}
+
+	result := reviewResponse.Response.Result
+	if reviewResponse.Response.Allowed || result == nil {
+		t.Fatal("Expecting review request to be refused")
+	}
+	if result.Message != "first problem; second problem" {
+		t.Errorf("Expecting every violation in the message, got %q", result.Message)
+	}
+	if result.Details == nil || len(result.Details.Causes) != 2 {
+		t.Fatal("Expecting a cause per violation")
+	}
+	if cause := result.Details.Causes[1]; cause.Field != "data[b]" || string(cause.Type) != "test.b" || cause.Message != "second problem" {
+		t.Errorf("Unexpected cause %+v", cause)
+	}
+}
+
+func TestEmptyViolationsAllowed(t *testing.T) {
+	if result := reviewWith(context.Background(), &violationsHandler{Violations{}}, UnmarshalPromAR(t, validQuery)); !result.Allowed {
+		t.Error("Expecting empty violations to be allowed")
+	}
+}
@@ -0,0 +1,119 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Every handler served, keyed by path, and the message templates. The active
+// set can be replaced atomically with SetHandlers, e.g. when the
+// configuration is reloaded: requests already in progress complete with the
+// handlers and templates they started with, and later requests see only the
+// new set.
+type HandlerSet struct {
+	handlers   map[string]AdmissionReviewHandler
+	dispatcher *DispatchAdmissionController
+	messages   map[string]compiledMessageTemplate
+}
+
+var (
+	activeHandlers atomic.Value
+	// serialises updates made with RegisterHandler and friends
+	updateLock sync.Mutex
+)
+
+func init() {
+	activeHandlers.Store(NewHandlerSet())
+}
+
+func NewHandlerSet() *HandlerSet {
+	return &HandlerSet{
+		handlers:   make(map[string]AdmissionReviewHandler),
+		dispatcher: &DispatchAdmissionController{},
+	}
+}
+
+func (s *HandlerSet) Register(path string, handler AdmissionReviewHandler) {
+	s.handlers[path] = asPolicy(handler)
+}
+
+// Register a handler to be run for every AdmissionReview received on
+// DispatchPath that matches the rule
+func (s *HandlerSet) RegisterDispatch(rule MatchRule, handler AdmissionReviewHandler) {
+	if _, found := s.handlers[DispatchPath]; !found {
+		s.handlers[DispatchPath] = s.dispatcher
+	}
+	s.dispatcher.Register(rule, asPolicy(handler))
+}
+
+// The registered paths, in order
+func (s *HandlerSet) Paths() []string {
+	paths := make([]string, 0, len(s.handlers))
+	for path := range s.handlers {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// handlers registered directly are enforced, with no exemptions, so that their
+// decisions are recorded like any other
+func asPolicy(handler AdmissionReviewHandler) AdmissionReviewHandler {
+	switch handler.(type) {
+	case *Policy, *DispatchAdmissionController:
+		return handler
+	}
+	return &Policy{Name: fmt.Sprintf("%T", handler), Handler: handler, Enforcement: EnforcementEnforce}
+}
+
+func (s *HandlerSet) clone() *HandlerSet {
+	clone := NewHandlerSet()
+	for path, handler := range s.handlers {
+		if handler == s.dispatcher {
+			handler = clone.dispatcher
+		}
+		clone.handlers[path] = handler
+	}
+	clone.messages = s.messages
+	clone.dispatcher.Mode = s.dispatcher.Mode
+	clone.dispatcher.routes = append(clone.dispatcher.routes, s.dispatcher.routes...)
+	return clone
+}
+
+// Replace every registered handler at once
+func SetHandlers(set *HandlerSet) {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+	activeHandlers.Store(set)
+}
+
+func currentHandlers() *HandlerSet {
+	return activeHandlers.Load().(*HandlerSet)
+}
+
+// apply a change to a copy of the active set, then swap it in, so that
+// requests in progress never see a partially updated set
+func updateHandlers(update func(set *HandlerSet)) {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	set := currentHandlers().clone()
+	update(set)
+	activeHandlers.Store(set)
+}
@@ -0,0 +1,150 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+// blocks in Review until released
+type blockingHandler struct {
+	started  chan struct{}
+	released chan struct{}
+}
+
+func (h *blockingHandler) Admit(ar *v1beta1.AdmissionReview) error {
+	return nil
+}
+
+func (h *blockingHandler) Review(ctx context.Context, ar *v1beta1.AdmissionReview) *AdmissionResult {
+	close(h.started)
+	<-h.released
+	return &AdmissionResult{Allowed: true}
+}
+
+func serve(path string) *http.Response {
+	req := httptest.NewRequest("POST", path, strings.NewReader(review))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	serveAdmission(w, req)
+	return w.Result()
+}
+
+func TestServeRegisteredPaths(t *testing.T) {
+	defer SetHandlers(NewHandlerSet())
+
+	set := NewHandlerSet()
+	set.Register("/test", &testHandler{})
+	SetHandlers(set)
+
+	if resp := serve("/test"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expecting registered path to be served, got %d", resp.StatusCode)
+	}
+	if resp := serve("/other"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expecting unregistered path to be not found, got %d", resp.StatusCode)
+	}
+}
+
+func TestSwapHandlersDuringRequest(t *testing.T) {
+	defer SetHandlers(NewHandlerSet())
+
+	blocking := &blockingHandler{started: make(chan struct{}), released: make(chan struct{})}
+	set := NewHandlerSet()
+	set.Register("/test", blocking)
+	SetHandlers(set)
+
+	responses := make(chan *http.Response)
+	go func() {
+		responses <- serve("/test")
+	}()
+	<-blocking.started
+
+	// the in-flight request should complete with the old handler
+	SetHandlers(NewHandlerSet())
+	close(blocking.released)
+	if resp := <-responses; resp.StatusCode != http.StatusOK {
+		t.Errorf("Expecting in-flight request to complete, got %d", resp.StatusCode)
+	}
+
+	if resp := serve("/test"); resp.StatusCode != http.StatusNotFound {
+		t.Error("Expecting later requests to use the new handlers")
+	}
+}
+
+func TestRegisterHandlerCopiesActiveSet(t *testing.T) {
+	defer SetHandlers(NewHandlerSet())
+
+	RegisterDispatchHandler(MatchRule{Resources: []string{"services"}}, &testHandler{fail: true})
+	before := currentHandlers()
+	RegisterHandler("/test", &testHandler{})
+
+	if _, found := before.handlers["/test"]; found {
+		t.Error("Expecting registration not to modify the previously active set")
+	}
+	if paths := currentHandlers().Paths(); len(paths) != 2 || paths[0] != "/test" || paths[1] != DispatchPath {
+		t.Errorf("Unexpected paths %v", paths)
+	}
+	if err := currentHandlers().handlers[DispatchPath].Admit(UnmarshalAR(unannotatedJson)); err == nil {
+		t.Error("Expecting dispatch routes to be kept")
+	}
+}
+
+// replaces the active set while reviewing, as a reload would
+type swappingHandler struct {
+	next *HandlerSet
+}
+
+func (h *swappingHandler) Admit(ar *v1beta1.AdmissionReview) error {
+	SetHandlers(h.next)
+	return Violations{{RuleID: "test", Message: "handler message"}}
+}
+
+func TestSwapMessageTemplatesDuringRequest(t *testing.T) {
+	defer SetHandlers(NewHandlerSet())
+
+	next := NewHandlerSet()
+	next.Register("/test", &violationsHandler{Violations{{RuleID: "test", Message: "handler message"}}})
+	if err := next.SetMessageTemplates(map[string]MessageTemplate{"test": {Template: "new template"}}); err != nil {
+		t.Fatal(err)
+	}
+	set := NewHandlerSet()
+	set.Register("/test", &swappingHandler{next: next})
+	if err := set.SetMessageTemplates(map[string]MessageTemplate{"test": {Template: "old template"}}); err != nil {
+		t.Fatal(err)
+	}
+	SetHandlers(set)
+
+	message := func() string {
+		reviewResponse := v1beta1.AdmissionReview{}
+		if err := json.NewDecoder(serve("/test").Body).Decode(&reviewResponse); err != nil {
+			t.Fatal(err)
+		}
+		return reviewResponse.Response.Result.Message
+	}
+	// the in-flight request should complete with the old templates
+	if m := message(); m != "old template" {
+		t.Errorf("Expecting the templates of the set the request started with, got %q", m)
+	}
+	if m := message(); m != "new template" {
+		t.Errorf("Expecting later requests to use the new templates, got %q", m)
+	}
+}
@@ -0,0 +1,155 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Limit how many requests a policy reviews at once, so that one expensive
+// handler can't starve the others during a burst. Requests beyond the limit
+// wait in a bounded queue; when the queue is full, or they've waited too
+// long, they're shed: allowed or denied without being reviewed.
+
+type ShedAction string
+
+const (
+	ShedAllow ShedAction = "allow"
+	ShedDeny  ShedAction = "deny"
+)
+
+type ConcurrencyLimit struct {
+	// The most requests reviewed at once
+	MaxConcurrent int `yaml:"maxConcurrent" json:"maxConcurrent"`
+	// The most requests waiting for a review. 0 sheds every request beyond
+	// MaxConcurrent immediately.
+	MaxQueued int `yaml:"maxQueued" json:"maxQueued"`
+	// How long a request waits before being shed. Defaults to 1s.
+	QueueTimeout time.Duration `yaml:"queueTimeout" json:"queueTimeout"`
+	// Whether shed requests are allowed or denied. Defaults to deny.
+	Shed ShedAction `yaml:"shed" json:"shed"`
+	// The message returned when a request is shed
+	Message string `yaml:"message,omitempty" json:"message,omitempty"`
+}
+
+func (l *ConcurrencyLimit) Validate() error {
+	if l.MaxConcurrent < 1 {
+		return fmt.Errorf("maxConcurrent must be at least 1")
+	}
+	if l.MaxQueued < 0 || l.QueueTimeout < 0 {
+		return fmt.Errorf("maxQueued and queueTimeout must not be negative")
+	}
+	if l.Shed != "" && l.Shed != ShedAllow && l.Shed != ShedDeny {
+		return fmt.Errorf("shed must be one of '%s' or '%s', not '%s'", ShedAllow, ShedDeny, l.Shed)
+	}
+	return nil
+}
+
+var (
+	inFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "admission_webhook",
+		Name:      "handler_requests_in_flight",
+		Help:      "Requests being reviewed by each concurrency limited handler.",
+	}, []string{"handler"})
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "admission_webhook",
+		Name:      "handler_queue_depth",
+		Help:      "Requests waiting to be reviewed by each concurrency limited handler.",
+	}, []string{"handler"})
+	shedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "admission_webhook",
+		Name:      "handler_shed_requests_total",
+		Help:      "Requests shed by each handler, by reason and shed action.",
+	}, []string{"handler", "reason", "action"})
+)
+
+func init() {
+	prometheus.MustRegister(inFlight, queueDepth, shedRequests)
+}
+
+type limiter struct {
+	ConcurrencyLimit
+	name   string
+	slots  chan struct{}
+	queued int32
+}
+
+func newLimiter(name string, limit ConcurrencyLimit) *limiter {
+	if limit.QueueTimeout == 0 {
+		limit.QueueTimeout = time.Second
+	}
+	if limit.Shed == "" {
+		limit.Shed = ShedDeny
+	}
+	return &limiter{ConcurrencyLimit: limit, name: name, slots: make(chan struct{}, limit.MaxConcurrent)}
+}
+
+// acquire a slot, waiting in the queue if needed. Returns the reason the
+// request was shed if no slot was available.
+func (l *limiter) acquire(ctx context.Context) (string, bool) {
+	select {
+	case l.slots <- struct{}{}:
+		inFlight.WithLabelValues(l.name).Inc()
+		return "", true
+	default:
+	}
+
+	if int(atomic.AddInt32(&l.queued, 1)) > l.MaxQueued {
+		atomic.AddInt32(&l.queued, -1)
+		return "queue_full", false
+	}
+	queueDepth.WithLabelValues(l.name).Inc()
+	defer func() {
+		atomic.AddInt32(&l.queued, -1)
+		queueDepth.WithLabelValues(l.name).Dec()
+	}()
+
+	timer := time.NewTimer(l.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		inFlight.WithLabelValues(l.name).Inc()
+		return "", true
+	case <-timer.C:
+		return "timeout", false
+	case <-ctx.Done():
+		return "cancelled", false
+	}
+}
+
+func (l *limiter) release() {
+	<-l.slots
+	inFlight.WithLabelValues(l.name).Dec()
+}
+
+// the result returned for a shed request
+func (l *limiter) shed(reason string, action ShedAction) *AdmissionResult {
+	shedRequests.WithLabelValues(l.name, reason, string(action)).Inc()
+
+	message := l.Message
+	if message == "" {
+		message = fmt.Sprintf("The %s admission policy is overloaded, please retry", l.name)
+	}
+	if action == ShedAllow {
+		return &AdmissionResult{Allowed: true, Warnings: []string{message}}
+	}
+	return &AdmissionResult{Allowed: false, Message: message}
+}
@@ -0,0 +1,136 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+// gatedHandler blocks every review until the gate is closed
+type gatedHandler struct {
+	started chan struct{}
+	gate    chan struct{}
+}
+
+func (h *gatedHandler) Admit(ar *v1beta1.AdmissionReview) error {
+	return nil
+}
+
+func (h *gatedHandler) Review(ctx context.Context, ar *v1beta1.AdmissionReview) *AdmissionResult {
+	h.started <- struct{}{}
+	<-h.gate
+	return &AdmissionResult{Allowed: true}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	handler := &gatedHandler{started: make(chan struct{}, 10), gate: make(chan struct{})}
+	policy := &Policy{
+		Name:        "limited",
+		Handler:     handler,
+		Concurrency: &ConcurrencyLimit{MaxConcurrent: 1, MaxQueued: 1, QueueTimeout: time.Minute},
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*AdmissionResult, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = policy.Review(context.Background(), UnmarshalAR(unannotatedJson))
+		}(i)
+	}
+
+	// one request is reviewed and the other queued, so a third is shed
+	<-handler.started
+	for atomic.LoadInt32(&policy.concurrencyLimiter().queued) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if result := policy.Review(context.Background(), UnmarshalAR(unannotatedJson)); result.Allowed || result.Message == "" {
+		t.Errorf("Expecting a request beyond the queue to be denied, got %+v", result)
+	}
+
+	close(handler.gate)
+	wg.Wait()
+	for _, result := range results {
+		if !result.Allowed {
+			t.Errorf("Expecting the running and queued requests to be reviewed, got %+v", result)
+		}
+	}
+	if counts := policy.counts.totals(); counts[OutcomeShed] != 1 || counts[OutcomeAllowed] != 2 {
+		t.Errorf("Expecting the shed request to be counted, got %v", counts)
+	}
+}
+
+func TestShedAllowOnTimeout(t *testing.T) {
+	handler := &gatedHandler{started: make(chan struct{}, 10), gate: make(chan struct{})}
+	defer close(handler.gate)
+	policy := &Policy{
+		Name:    "limited",
+		Handler: handler,
+		Concurrency: &ConcurrencyLimit{
+			MaxConcurrent: 1,
+			MaxQueued:     1,
+			QueueTimeout:  10 * time.Millisecond,
+			Shed:          ShedAllow,
+			Message:       "Overloaded, allowing without review",
+		},
+	}
+
+	go policy.Review(context.Background(), UnmarshalAR(unannotatedJson))
+	<-handler.started
+
+	result := policy.Review(context.Background(), UnmarshalAR(unannotatedJson))
+	if !result.Allowed || len(result.Warnings) != 1 || result.Warnings[0] != "Overloaded, allowing without review" {
+		t.Errorf("Expecting a queued request to be allowed with a warning after the timeout, got %+v", result)
+	}
+}
+
+func TestShedAllowedWhenNotEnforcing(t *testing.T) {
+	for _, mode := range []EnforcementMode{EnforcementWarn, EnforcementDryRun} {
+		handler := &gatedHandler{started: make(chan struct{}, 10), gate: make(chan struct{})}
+		policy := &Policy{
+			Name:        "limited",
+			Handler:     handler,
+			Enforcement: mode,
+			Concurrency: &ConcurrencyLimit{MaxConcurrent: 1, QueueTimeout: time.Minute, Shed: ShedDeny},
+		}
+
+		go policy.Review(context.Background(), UnmarshalAR(unannotatedJson))
+		<-handler.started
+
+		if result := policy.Review(context.Background(), UnmarshalAR(unannotatedJson)); !result.Allowed || len(result.Warnings) != 1 {
+			t.Errorf("Expecting a shed request to be allowed in %s mode, got %+v", mode, result)
+		}
+		close(handler.gate)
+	}
+}
+
+func TestConcurrencyLimitValidate(t *testing.T) {
+	for _, limit := range []ConcurrencyLimit{
+		{MaxConcurrent: 0},
+		{MaxConcurrent: 1, MaxQueued: -1},
+		{MaxConcurrent: 1, Shed: "sometimes"},
+	} {
+		if err := limit.Validate(); err == nil {
+			t.Errorf("Expecting %+v to be invalid", limit)
+		}
+	}
+}
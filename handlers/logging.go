@@ -0,0 +1,163 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-logfmt/logfmt"
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+)
+
+// Structured logging. Each admission request is given a logger carrying the
+// request's UID, resource, namespace, name and user, and each Policy adds its
+// name, so every line logged while handling the request can be correlated.
+// Handlers implementing AdmissionReviewResultHandler should log through
+// LoggerFrom(ctx), with the go-kit level helpers:
+//
+//  level.Debug(LoggerFrom(ctx)).Log("msg", "Reviewing service", "type", service.Spec.Type)
+
+const (
+	// Through glog, as logfmt key/value pairs. Debug lines are logged at -v=2.
+	LogFormatGlog = "glog"
+	// One logfmt line per entry
+	LogFormatLogfmt = "logfmt"
+	// One JSON object per line
+	LogFormatJSON = "json"
+)
+
+var (
+	loggerLock sync.RWMutex
+	logger     log.Logger = glogLogger{}
+)
+
+type loggerKey struct{}
+
+// Create a logger writing entries in the given format at or above the given
+// level (debug, info, warn or error). The level is ignored by the glog format,
+// which uses glog's verbosity instead.
+func NewLogger(format, minLevel string, w io.Writer) (log.Logger, error) {
+	var l log.Logger
+	switch format {
+	case "", LogFormatGlog:
+		return glogLogger{}, nil
+	case LogFormatLogfmt:
+		l = log.NewLogfmtLogger(log.NewSyncWriter(w))
+	case LogFormatJSON:
+		l = log.NewJSONLogger(log.NewSyncWriter(w))
+	default:
+		return nil, fmt.Errorf("log format must be one of '%s', '%s' or '%s', not '%s'", LogFormatGlog, LogFormatLogfmt, LogFormatJSON, format)
+	}
+
+	var allow level.Option
+	switch minLevel {
+	case "debug":
+		allow = level.AllowDebug()
+	case "", "info":
+		allow = level.AllowInfo()
+	case "warn":
+		allow = level.AllowWarn()
+	case "error":
+		allow = level.AllowError()
+	default:
+		return nil, fmt.Errorf("log level must be one of 'debug', 'info', 'warn' or 'error', not '%s'", minLevel)
+	}
+
+	l = log.With(l, "ts", log.DefaultTimestampUTC)
+	return level.NewFilter(l, allow), nil
+}
+
+// Set the logger that request loggers are derived from
+func SetLogger(l log.Logger) {
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	logger = l
+}
+
+func baseLogger() log.Logger {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
+	return logger
+}
+
+// Return a copy of the context carrying the logger
+func WithLogger(ctx context.Context, l log.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// The logger for the request being handled, or the base logger outside a
+// request
+func LoggerFrom(ctx context.Context) log.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(log.Logger); ok {
+		return l
+	}
+	return baseLogger()
+}
+
+// add the request's fields to the logger
+func requestLogger(l log.Logger, ar *v1beta1.AdmissionReview) log.Logger {
+	meta := objectMeta(ar)
+	return log.With(l,
+		"uid", ar.Request.UID,
+		"resource", ar.Request.Resource.String(),
+		"namespace", meta.Namespace,
+		"name", meta.Name,
+		"user", ar.Request.UserInfo.Username,
+	)
+}
+
+// glogLogger writes entries to glog, at the glog severity matching the
+// entry's level
+type glogLogger struct{}
+
+func (glogLogger) Log(keyvals ...interface{}) error {
+	lvl := level.InfoValue()
+	fields := make([]interface{}, 0, len(keyvals))
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == level.Key() {
+			if v, ok := keyvals[i+1].(level.Value); ok {
+				lvl = v
+				continue
+			}
+		}
+		fields = append(fields, keyvals[i], keyvals[i+1])
+	}
+
+	var line bytes.Buffer
+	if err := logfmt.NewEncoder(&line).EncodeKeyvals(fields...); err != nil {
+		return err
+	}
+
+	switch lvl {
+	case level.ErrorValue():
+		glog.Error(line.String())
+	case level.WarnValue():
+		glog.Warning(line.String())
+	case level.DebugValue():
+		if glog.V(2) {
+			glog.Info(line.String())
+		}
+	default:
+		glog.Info(line.String())
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/admission/v1beta1"
+)
+
+// loggingHandler logs through the request's logger
+type loggingHandler struct{}
+
+func (h *loggingHandler) Admit(ar *v1beta1.AdmissionReview) error {
+	return nil
+}
+
+func (h *loggingHandler) Review(ctx context.Context, ar *v1beta1.AdmissionReview) *AdmissionResult {
+	level.Info(LoggerFrom(ctx)).Log("msg", "Handler log line")
+	return &AdmissionResult{Allowed: true}
+}
+
+func TestRequestLogFields(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := NewLogger(LogFormatJSON, "info", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetLogger(logger)
+	defer SetLogger(glogLogger{})
+
+	policy := &Policy{Name: "logging", Handler: &loggingHandler{}}
+	req := httptest.NewRequest("POST", "/logging", strings.NewReader(unannotatedJson))
+	req.Header.Set("Content-Type", "application/json")
+	handleRequest(httptest.NewRecorder(), req, policy)
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Expecting a JSON object per line: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("Expecting only the handler's line at info level, got %v", entries)
+	}
+	expected := map[string]string{
+		"msg":       "Handler log line",
+		"level":     "info",
+		"uid":       "681f0022-306f-11e8-8d4f-b827ebf9752a",
+		"handler":   "logging",
+		"resource":  "/v1, Resource=services",
+		"namespace": "default",
+		"name":      "test-service",
+		"user":      "kubernetes-admin",
+		"path":      "/logging",
+	}
+	for k, v := range expected {
+		if entries[0][k] != v {
+			t.Errorf("Expecting %s=%s, got %v", k, v, entries[0][k])
+		}
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := NewLogger(LogFormatLogfmt, "warn", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	level.Info(logger).Log("msg", "filtered")
+	level.Warn(logger).Log("msg", "kept", "handler", "test")
+
+	if line := out.String(); strings.Contains(line, "filtered") || !strings.Contains(line, `level=warn msg=kept handler=test`) {
+		t.Errorf("Expecting only the warning in logfmt, got %s", line)
+	}
+
+	if _, err := NewLogger("xml", "", &out); err == nil {
+		t.Error("Expecting an unknown format to be refused")
+	}
+	if _, err := NewLogger(LogFormatJSON, "verbose", &out); err == nil {
+		t.Error("Expecting an unknown level to be refused")
+	}
+}
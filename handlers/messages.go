@@ -0,0 +1,164 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/admission/v1beta1"
+)
+
+// Replace the message shown to users for violations of a rule, e.g. to link
+// to internal documentation explaining how to comply with it.
+//
+// Template is a text/template, executed with a MessageData. Templates are
+// looked up by the violation's RuleID, falling back to the DefaultMessageRule
+// template if there is one. Violations of rules without a template keep the
+// message provided by the handler.
+type MessageTemplate struct {
+	Template         string `yaml:"template" json:"template"`
+	DocumentationURL string `yaml:"documentationURL" json:"documentationURL,omitempty"`
+}
+
+// The template used for violations of rules without a template of their own
+const DefaultMessageRule = "*"
+
+// The data available to a MessageTemplate
+type MessageData struct {
+	// The object being admitted
+	Name      string
+	Namespace string
+	Kind      string
+	Operation string
+	// The user making the request
+	User   string
+	Groups []string
+	// The violation, including the message provided by the handler
+	Violation        Violation
+	DocumentationURL string
+}
+
+type compiledMessageTemplate struct {
+	template         *template.Template
+	documentationURL string
+}
+
+// Replace the current message templates, keyed by rule ID. If any of the
+// templates fail to parse, an error is returned and the current templates are
+// left in place.
+func SetMessageTemplates(templates map[string]MessageTemplate) error {
+	compiled, err := compileMessageTemplates(templates)
+	if err != nil {
+		return err
+	}
+	updateHandlers(func(set *HandlerSet) {
+		set.messages = compiled
+	})
+	return nil
+}
+
+// Use the message templates when the set is active, so that they're replaced
+// along with its handlers
+func (s *HandlerSet) SetMessageTemplates(templates map[string]MessageTemplate) error {
+	compiled, err := compileMessageTemplates(templates)
+	if err != nil {
+		return err
+	}
+	s.messages = compiled
+	return nil
+}
+
+type messageTemplatesKey struct{}
+
+// the templates of the HandlerSet the request was routed with
+func withMessageTemplates(ctx context.Context, templates map[string]compiledMessageTemplate) context.Context {
+	return context.WithValue(ctx, messageTemplatesKey{}, templates)
+}
+
+// the templates the request was routed with, or the active templates
+func messageTemplatesFrom(ctx context.Context) map[string]compiledMessageTemplate {
+	if templates, ok := ctx.Value(messageTemplatesKey{}).(map[string]compiledMessageTemplate); ok {
+		return templates
+	}
+	return currentHandlers().messages
+}
+
+// Check that the templates parse, without replacing the current templates
+func ValidateMessageTemplates(templates map[string]MessageTemplate) error {
+	_, err := compileMessageTemplates(templates)
+	return err
+}
+
+func compileMessageTemplates(templates map[string]MessageTemplate) (map[string]compiledMessageTemplate, error) {
+	compiled := make(map[string]compiledMessageTemplate, len(templates))
+	for rule, t := range templates {
+		// fail on references to fields that don't exist, rather than
+		// rendering "<no value>" to the user
+		tmpl, err := template.New(rule).Option("missingkey=error").Parse(t.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message template for rule '%s': %v", rule, err)
+		}
+		compiled[rule] = compiledMessageTemplate{template: tmpl, documentationURL: t.DocumentationURL}
+	}
+	return compiled, nil
+}
+
+// render the messages of any violations that have templates configured
+func renderViolations(ctx context.Context, ar *v1beta1.AdmissionReview, violations Violations) Violations {
+	messageTemplates := messageTemplatesFrom(ctx)
+	if len(messageTemplates) == 0 {
+		return violations
+	}
+
+	meta := objectMeta(ar)
+	rendered := make(Violations, len(violations))
+	for i, violation := range violations {
+		rendered[i] = violation
+		if violation.rendered {
+			continue
+		}
+
+		t, found := messageTemplates[violation.RuleID]
+		if !found {
+			if t, found = messageTemplates[DefaultMessageRule]; !found {
+				continue
+			}
+		}
+
+		data := MessageData{
+			Name:             meta.Name,
+			Namespace:        meta.Namespace,
+			Kind:             ar.Request.Kind.Kind,
+			Operation:        string(ar.Request.Operation),
+			User:             ar.Request.UserInfo.Username,
+			Groups:           ar.Request.UserInfo.Groups,
+			Violation:        violation,
+			DocumentationURL: t.documentationURL,
+		}
+
+		var message bytes.Buffer
+		if err := t.template.Execute(&message, data); err != nil {
+			level.Error(LoggerFrom(ctx)).Log("msg", "Unable to render message template", "rule", violation.RuleID, "err", err)
+			continue
+		}
+		rendered[i].Message = message.String()
+		rendered[i].rendered = true
+	}
+	return rendered
+}
@@ -0,0 +1,78 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMessageTemplates(t *testing.T) {
+	err := SetMessageTemplates(map[string]MessageTemplate{
+		"gkepublicservice.opt-in": {
+			Template:         `{{.Kind}} {{.Namespace}}/{{.Name}} created by {{.User}} must be internal, see {{.DocumentationURL}} ({{.Violation.Field}})`,
+			DocumentationURL: "https://docs.example.com/public-services",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetMessageTemplates(nil)
+
+	result := reviewWith(context.Background(), &GkeServiceAdmissionController{}, UnmarshalAR(unannotatedJson))
+	expected := "Service default/test-service created by kubernetes-admin must be internal, see https://docs.example.com/public-services (metadata.annotations[gke/load-balancer-type])"
+	if result.Allowed || result.Message != expected {
+		t.Errorf("Expecting templated message, got %q", result.Message)
+	}
+	if result.Violations[0].Message != expected {
+		t.Errorf("Expecting templated violation, got %q", result.Violations[0].Message)
+	}
+}
+
+func TestDefaultMessageTemplate(t *testing.T) {
+	err := SetMessageTemplates(map[string]MessageTemplate{
+		DefaultMessageRule: {Template: `[{{.Violation.RuleID}}] {{.Violation.Message}}`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetMessageTemplates(nil)
+
+	// the composite shouldn't render the message a second time
+	composite := &CompositeAdmissionController{Handlers: []AdmissionReviewHandler{&PrometheusRulesAdmissionController{}}}
+	result := reviewWith(context.Background(), composite, UnmarshalPromAR(t, invalidQuery))
+	expected := "[prometheuslinter.syntax] Prometheus linter failed for ConfigMap 'test-rules' key 'test.rules': "
+	if result.Allowed || len(result.Message) < len(expected) || result.Message[:len(expected)] != expected {
+		t.Errorf("Expecting default templated message, got %q", result.Message)
+	}
+}
+
+func TestInvalidMessageTemplate(t *testing.T) {
+	if err := SetMessageTemplates(map[string]MessageTemplate{"test": {Template: "{{.Name"}}); err == nil {
+		t.Error("Expecting invalid template to be refused")
+	}
+}
+
+func TestMessageTemplateExecutionFailure(t *testing.T) {
+	if err := SetMessageTemplates(map[string]MessageTemplate{DefaultMessageRule: {Template: "{{.Missing}}"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetMessageTemplates(nil)
+
+	result := reviewWith(context.Background(), &GkeServiceAdmissionController{}, UnmarshalAR(unannotatedJson))
+	if result.Message != "The service 'test-service' is public, and so disallowed without the explicit 'gke/load-balancer-type' annotation." {
+		t.Errorf("Expecting handler message to be kept when the template fails, got %q", result.Message)
+	}
+}
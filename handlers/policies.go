@@ -0,0 +1,149 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// The /policies endpoint, describing every active handler so that users can
+// see which policies apply to them and how they're configured. Served as JSON,
+// or as HTML with ?format=html or to browsers.
+
+const PoliciesPath = "/policies"
+
+type PolicyDescription struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Paths       []string          `json:"paths"`
+	Enforcement EnforcementMode   `json:"enforcement"`
+	Exemptions  Exemptions        `json:"exemptions"`
+	Concurrency *ConcurrencyLimit `json:"concurrency,omitempty"`
+	Cache       *CacheOptions     `json:"cache,omitempty"`
+	// The requests the policy is run for from the dispatch endpoint
+	Rules []MatchRule `json:"rules,omitempty"`
+	// The handler's configuration
+	Parameters interface{} `json:"parameters"`
+	// Decisions made over the last hour, by outcome
+	RecentDecisions map[DecisionOutcome]uint64 `json:"recentDecisions"`
+}
+
+// Describe every handler in the set, ordered by name
+func (s *HandlerSet) Policies() []PolicyDescription {
+	descriptions := map[AdmissionReviewHandler]*PolicyDescription{}
+	describe := func(handler AdmissionReviewHandler) *PolicyDescription {
+		if d, found := descriptions[handler]; found {
+			return d
+		}
+
+		d := &PolicyDescription{
+			Name:            fmt.Sprintf("%T", handler),
+			Enforcement:     EnforcementEnforce,
+			Parameters:      handler,
+			RecentDecisions: map[DecisionOutcome]uint64{},
+		}
+		if policy, ok := handler.(*Policy); ok {
+			d.Name = policy.Name
+			d.Description = policy.Description
+			d.Enforcement = policy.enforcement()
+			d.Exemptions = policy.Exemptions
+			d.Concurrency = policy.Concurrency
+			d.Cache = policy.Cache
+			d.Parameters = policy.Handler
+			d.RecentDecisions = policy.counts.totals()
+		}
+		descriptions[handler] = d
+		return d
+	}
+
+	for _, path := range s.Paths() {
+		if handler := s.handlers[path]; handler != AdmissionReviewHandler(s.dispatcher) {
+			d := describe(handler)
+			d.Paths = append(d.Paths, path)
+		}
+	}
+	for _, route := range s.dispatcher.routes {
+		d := describe(route.handler)
+		if len(d.Rules) == 0 {
+			d.Paths = append(d.Paths, DispatchPath)
+		}
+		d.Rules = append(d.Rules, route.rule)
+	}
+
+	list := make([]PolicyDescription, 0, len(descriptions))
+	for _, d := range descriptions {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+var policiesTemplate = template.Must(template.New("policies").Funcs(template.FuncMap{
+	"join": strings.Join,
+	"json": func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Admission policies</title></head>
+<body>
+<h1>Admission policies</h1>
+<table border="1" cellpadding="4">
+<tr><th>Name</th><th>Description</th><th>Paths</th><th>Enforcement</th><th>Exemptions</th><th>Rules</th><th>Parameters</th><th>Decisions (last hour)</th></tr>
+{{range .}}<tr>
+<td>{{.Name}}</td>
+<td>{{.Description}}</td>
+<td>{{join .Paths ", "}}</td>
+<td>{{.Enforcement}}</td>
+<td>{{with .Exemptions.Namespaces}}namespaces: {{join . ", "}}<br>{{end}}{{with .Exemptions.Users}}users: {{join . ", "}}<br>{{end}}{{with .Exemptions.Groups}}groups: {{join . ", "}}{{end}}</td>
+<td>{{range .Rules}}<code>{{json .}}</code><br>{{end}}</td>
+<td><code>{{json .Parameters}}</code></td>
+<td>{{range $outcome, $count := .RecentDecisions}}{{$outcome}}: {{$count}}<br>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func servePolicies(w http.ResponseWriter, r *http.Request) {
+	policies := currentHandlers().Policies()
+
+	if r.URL.Query().Get("format") == "html" || (r.URL.Query().Get("format") == "" && strings.Contains(r.Header.Get("Accept"), "text/html")) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := policiesTemplate.Execute(w, policies); err != nil {
+			level.Error(baseLogger()).Log("msg", "Unable to render policies", "err", err)
+		}
+		return
+	}
+
+	resp, err := json.MarshalIndent(policies, "", "  ")
+	if err != nil {
+		level.Error(baseLogger()).Log("msg", "Unable to encode policies", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		level.Error(baseLogger()).Log("msg", "Unable to write response", "err", err)
+	}
+}
@@ -0,0 +1,147 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getPolicies(token, query string) *http.Response {
+	req := httptest.NewRequest("GET", PoliciesPath+query, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	requireAdmin(servePolicies)(w, req)
+	return w.Result()
+}
+
+func testPolicySet() (*HandlerSet, *Policy) {
+	policy := &Policy{
+		Name:        "gkepublicservice",
+		Description: "Test description",
+		Handler:     &GkeServiceAdmissionController{},
+		Enforcement: EnforcementWarn,
+		Exemptions:  Exemptions{Namespaces: []string{"kube-system"}},
+	}
+	set := NewHandlerSet()
+	set.Register("/gkepublicservice", policy)
+	set.RegisterDispatch(MatchRule{Resources: []string{"services"}}, policy)
+	set.Register("/test", &testHandler{})
+	return set, policy
+}
+
+func TestPoliciesAuthentication(t *testing.T) {
+	SetAdminTokens([]string{"secret"})
+	defer SetAdminTokens(nil)
+
+	if resp := getPolicies("", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expecting unauthenticated request to be refused, got %d", resp.StatusCode)
+	}
+	if resp := getPolicies("wrong", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expecting invalid token to be refused, got %d", resp.StatusCode)
+	}
+	if resp := getPolicies("secret", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expecting valid token to be accepted, got %d", resp.StatusCode)
+	}
+
+	SetAdminTokens(nil)
+	if resp := getPolicies("secret", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expecting every token to be refused when none are configured, got %d", resp.StatusCode)
+	}
+}
+
+func TestPoliciesJSON(t *testing.T) {
+	SetAdminTokens([]string{"secret"})
+	defer SetAdminTokens(nil)
+	defer SetHandlers(NewHandlerSet())
+
+	set, policy := testPolicySet()
+	SetHandlers(set)
+	policy.Admit(UnmarshalAR(unannotatedJson))
+	policy.Admit(UnmarshalAR(annotatedJson))
+
+	resp := getPolicies("secret", "")
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	var policies []PolicyDescription
+	if err := json.Unmarshal(body, &policies); err != nil {
+		t.Fatalf("Unable to unmarshal policies: %v", err)
+	}
+	if len(policies) != 2 {
+		t.Fatalf("Expecting every handler to be listed, got %s", body)
+	}
+
+	gke, unmanaged := policies[1], policies[0]
+	if gke.Name != "gkepublicservice" || gke.Description != "Test description" || gke.Enforcement != EnforcementWarn {
+		t.Errorf("Unexpected policy %+v", gke)
+	}
+	if len(gke.Paths) != 2 || gke.Paths[0] != "/gkepublicservice" || gke.Paths[1] != DispatchPath {
+		t.Errorf("Expecting both paths to be listed, got %v", gke.Paths)
+	}
+	if len(gke.Rules) != 1 || gke.Rules[0].Resources[0] != "services" {
+		t.Errorf("Expecting matched resources to be listed, got %v", gke.Rules)
+	}
+	if gke.Exemptions.Namespaces[0] != "kube-system" {
+		t.Errorf("Expecting exemptions to be listed, got %v", gke.Exemptions)
+	}
+	if gke.RecentDecisions[OutcomeWarned] != 1 || gke.RecentDecisions[OutcomeAllowed] != 1 {
+		t.Errorf("Expecting decision counts, got %v", gke.RecentDecisions)
+	}
+
+	if unmanaged.Name != "*handlers.testHandler" || unmanaged.Enforcement != EnforcementEnforce {
+		t.Errorf("Expecting unmanaged handler to be listed by type, got %+v", unmanaged)
+	}
+}
+
+func TestPoliciesHTML(t *testing.T) {
+	SetAdminTokens([]string{"secret"})
+	defer SetAdminTokens(nil)
+	defer SetHandlers(NewHandlerSet())
+
+	set, _ := testPolicySet()
+	SetHandlers(set)
+
+	resp := getPolicies("secret", "?format=html")
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(body), "<td>gkepublicservice</td>") {
+		t.Errorf("Expecting HTML policies, got %s", body)
+	}
+}
+
+func TestDecisionCountsWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	counts := decisionCounts{now: func() time.Time { return now }}
+
+	counts.record(OutcomeDenied)
+	now = now.Add(30 * time.Minute)
+	counts.record(OutcomeDenied)
+	counts.record(OutcomeAllowed)
+
+	if totals := counts.totals(); totals[OutcomeDenied] != 2 || totals[OutcomeAllowed] != 1 {
+		t.Errorf("Expecting decisions within the window to be counted, got %v", totals)
+	}
+
+	now = now.Add(45 * time.Minute)
+	if totals := counts.totals(); totals[OutcomeDenied] != 1 {
+		t.Errorf("Expecting decisions older than an hour to be dropped, got %v", totals)
+	}
+}
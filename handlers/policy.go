@@ -0,0 +1,210 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/admission/v1beta1"
+)
+
+// A handler, along with how its decisions are enforced and which requests it
+// doesn't apply to
+
+type EnforcementMode string
+
+const (
+	// Rejections are returned to the API server, and the object is refused
+	EnforcementEnforce EnforcementMode = "enforce"
+	// Rejections are returned to the user as warnings, but the object is
+	// allowed
+	EnforcementWarn EnforcementMode = "warn"
+	// Rejections are only logged, and the object is allowed
+	EnforcementDryRun EnforcementMode = "dryrun"
+)
+
+func (m EnforcementMode) Valid() bool {
+	switch m {
+	case "", EnforcementEnforce, EnforcementWarn, EnforcementDryRun:
+		return true
+	}
+	return false
+}
+
+// Requests matching any of these are allowed without consulting the handler
+type Exemptions struct {
+	Namespaces []string `yaml:"namespaces,omitempty" json:"namespaces,omitempty"`
+	Users      []string `yaml:"users,omitempty" json:"users,omitempty"`
+	Groups     []string `yaml:"groups,omitempty" json:"groups,omitempty"`
+}
+
+func (e *Exemptions) Exempt(request *v1beta1.AdmissionRequest) bool {
+	if contains(e.Namespaces, request.Namespace) || contains(e.Users, request.UserInfo.Username) {
+		return true
+	}
+	for _, group := range request.UserInfo.Groups {
+		if contains(e.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+type Policy struct {
+	Name string
+	// What the policy enforces, for the /policies endpoint
+	Description string
+	Handler     AdmissionReviewHandler
+	Enforcement EnforcementMode
+	Exemptions  Exemptions
+	// Limit the requests reviewed at once. nil is unlimited.
+	Concurrency *ConcurrencyLimit
+	// Cache results for identical requests. nil disables caching.
+	Cache *CacheOptions
+
+	counts      decisionCounts
+	limiter     *limiter
+	limiterOnce sync.Once
+	cache       *decisionCache
+	cacheOnce   sync.Once
+}
+
+// Handlers taking parameters from the configuration file implement this
+// interface. decode unmarshals the handler's parameters into the given
+// struct, failing on any unknown or mistyped parameters.
+type ParameterizedHandler interface {
+	AdmissionReviewHandler
+	SetParameters(decode func(into interface{}) error) error
+}
+
+func (p *Policy) Admit(ar *v1beta1.AdmissionReview) error {
+	return p.Review(context.Background(), ar).Err()
+}
+
+func (p *Policy) Review(ctx context.Context, ar *v1beta1.AdmissionReview) *AdmissionResult {
+	ctx = WithLogger(ctx, log.With(LoggerFrom(ctx), "handler", p.Name))
+	decision := newDecision(ar, p)
+	result, outcome := p.review(ctx, ar)
+
+	decision.Latency = time.Since(decision.Time)
+	decision.Outcome = outcome
+	decision.Allowed = result.Allowed
+	decision.Warnings = result.Warnings
+	if outcome != OutcomeAllowed && outcome != OutcomeExempt {
+		// results allowed by the enforcement mode keep the rejection's
+		// message, so that it can be recorded
+		decision.Message = result.Message
+		decision.Violations = result.Violations
+	}
+
+	p.counts.record(outcome)
+	recordDecision(decision)
+	return result
+}
+
+func (p *Policy) review(ctx context.Context, ar *v1beta1.AdmissionReview) (*AdmissionResult, DecisionOutcome) {
+	if p.Exemptions.Exempt(ar.Request) {
+		level.Debug(LoggerFrom(ctx)).Log("msg", "Request is exempt")
+		return &AdmissionResult{Allowed: true}, OutcomeExempt
+	}
+
+	var key [sha256.Size]byte
+	cacheable := false
+	if p.Cache != nil {
+		if key, cacheable = cacheKey(p.Handler, ar); cacheable {
+			if result, found := p.decisionCache().get(key); found {
+				return p.enforce(ctx, renderResult(ctx, ar, result))
+			}
+		}
+	}
+
+	if p.Concurrency != nil {
+		l := p.concurrencyLimiter()
+		if reason, ok := l.acquire(ctx); !ok {
+			// policies that don't enforce never deny, even when overloaded
+			action := l.Shed
+			if p.enforcement() != EnforcementEnforce {
+				action = ShedAllow
+			}
+			level.Warn(LoggerFrom(ctx)).Log("msg", "Shedding request", "reason", reason, "action", action)
+			return l.shed(reason, action), OutcomeShed
+		}
+		defer l.release()
+	}
+
+	result := runHandler(ctx, p.Handler, ar)
+	if cacheable {
+		p.decisionCache().add(key, result)
+	}
+	return p.enforce(ctx, renderResult(ctx, ar, result))
+}
+
+// apply the enforcement mode to the handler's result
+func (p *Policy) enforce(ctx context.Context, result *AdmissionResult) (*AdmissionResult, DecisionOutcome) {
+	if result.Allowed {
+		return result, OutcomeAllowed
+	}
+
+	switch p.enforcement() {
+	case EnforcementWarn:
+		level.Info(LoggerFrom(ctx)).Log("msg", "Allowing in warn mode", "rejection", result.Message)
+		return &AdmissionResult{
+			Allowed:    true,
+			Message:    result.Message,
+			Violations: result.Violations,
+			Warnings:   append(result.Warnings, fmt.Sprintf("%s: %s", p.Name, result.Message)),
+		}, OutcomeWarned
+	case EnforcementDryRun:
+		level.Info(LoggerFrom(ctx)).Log("msg", "Allowing in dry-run mode", "rejection", result.Message)
+		return &AdmissionResult{Allowed: true, Message: result.Message, Violations: result.Violations, Warnings: result.Warnings}, OutcomeDryRun
+	}
+	return result, OutcomeDenied
+}
+
+func (p *Policy) concurrencyLimiter() *limiter {
+	p.limiterOnce.Do(func() {
+		p.limiter = newLimiter(p.Name, *p.Concurrency)
+	})
+	return p.limiter
+}
+
+func (p *Policy) decisionCache() *decisionCache {
+	p.cacheOnce.Do(func() {
+		p.cache = newDecisionCache(p.Name, *p.Cache)
+	})
+	return p.cache
+}
+
+func (p *Policy) enforcement() EnforcementMode {
+	if p.Enforcement == "" {
+		return EnforcementEnforce
+	}
+	return p.Enforcement
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPolicyEnforce(t *testing.T) {
+	policy := Policy{Name: "test", Handler: &testHandler{fail: true}, Enforcement: EnforcementEnforce}
+	if err := policy.Admit(UnmarshalAR(unannotatedJson)); err == nil {
+		t.Error("Expecting enforced policy to disallow")
+	}
+}
+
+func TestPolicyWarn(t *testing.T) {
+	policy := Policy{Name: "test", Handler: &testHandler{fail: true}, Enforcement: EnforcementWarn}
+	result := policy.Review(context.Background(), UnmarshalAR(unannotatedJson))
+	if !result.Allowed {
+		t.Error("Expecting warn policy to allow")
+	}
+	if len(result.Warnings) != 1 || result.Warnings[0] != "test: Deliberately failing test" {
+		t.Errorf("Expecting the denial to be returned as a warning, got %v", result.Warnings)
+	}
+}
+
+func TestPolicyDryRun(t *testing.T) {
+	policy := Policy{Name: "test", Handler: &testHandler{fail: true}, Enforcement: EnforcementDryRun}
+	result := policy.Review(context.Background(), UnmarshalAR(unannotatedJson))
+	if !result.Allowed || len(result.Warnings) != 0 {
+		t.Error("Expecting dry-run policy to allow silently")
+	}
+}
+
+func TestPolicyExemptions(t *testing.T) {
+	handler := &resultHandler{result: AdmissionResult{Allowed: false}}
+	ar := UnmarshalAR(unannotatedJson)
+
+	exemptions := []Exemptions{
+		{Namespaces: []string{"default"}},
+		{Users: []string{"kubernetes-admin"}},
+		{Groups: []string{"system:masters"}},
+	}
+	for _, e := range exemptions {
+		policy := Policy{Name: "test", Handler: handler, Exemptions: e}
+		if err := policy.Admit(ar); err != nil {
+			t.Errorf("Expecting request to be exempted by %+v", e)
+		}
+	}
+	if handler.called != 0 {
+		t.Error("Expecting exempt requests not to reach the handler")
+	}
+
+	policy := Policy{Name: "test", Handler: handler, Exemptions: Exemptions{Namespaces: []string{"kube-system"}}}
+	if err := policy.Admit(ar); err == nil {
+		t.Error("Expecting non-exempt request to be disallowed")
+	}
+}
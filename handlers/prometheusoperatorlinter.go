@@ -17,10 +17,12 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 
 	"github.com/prometheus/prometheus/promql"
 )
@@ -29,6 +31,20 @@ import (
 
 type PrometheusRulesAdmissionController struct{}
 
+func init() {
+	RegisterHandlerFactory(HandlerFactory{
+		Name:        "prometheuslinter",
+		Description: "Rejects prometheus-operator rules ConfigMaps containing rules that fail to parse.",
+		DefaultRules: []MatchRule{{
+			Operations:  []v1beta1.Operation{v1beta1.Create, v1beta1.Update},
+			APIGroups:   []string{""},
+			APIVersions: []string{"v1"},
+			Resources:   []string{"configmaps"},
+		}},
+		New: func() AdmissionReviewHandler { return &PrometheusRulesAdmissionController{} },
+	})
+}
+
 func (g *PrometheusRulesAdmissionController) Admit(ar *v1beta1.AdmissionReview) error {
 	configmap, err := extractConfigMap(ar)
 	if err != nil {
@@ -38,19 +54,48 @@ func (g *PrometheusRulesAdmissionController) Admit(ar *v1beta1.AdmissionReview)
 	return admitConfigMap(configmap)
 }
 
+// Only the ConfigMap's name, role label and rules are reviewed
+func (g *PrometheusRulesAdmissionController) CacheContent(ar *v1beta1.AdmissionReview) ([]byte, bool) {
+	configmap, err := extractConfigMap(ar)
+	if err != nil {
+		return nil, false
+	}
+
+	content, err := json.Marshal([]interface{}{configmap.Name, configmap.Labels["role"], configmap.Data})
+	return content, err == nil
+}
+
 func lintString(content string) error {
 	_, err := promql.ParseStmts(content)
 	return err
 }
 
 func admitConfigMap(configmap *corev1.ConfigMap) error {
-	if configmap.Labels["role"] == "prometheus-rulefiles" {
-		for _, content := range configmap.Data {
-			if err := lintString(content); err != nil {
-				return fmt.Errorf("Prometheus linter failed for ConfigMap '%s': %v", configmap.Name, err)
-			}
+	if configmap.Labels["role"] != "prometheus-rulefiles" {
+		return nil
+	}
+
+	// report the keys in a stable order
+	keys := make([]string, 0, len(configmap.Data))
+	for key := range configmap.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var violations Violations
+	for _, key := range keys {
+		if err := lintString(configmap.Data[key]); err != nil {
+			violations = append(violations, Violation{
+				Field:   field.NewPath("data").Key(key).String(),
+				RuleID:  "prometheuslinter.syntax",
+				Message: fmt.Sprintf("Prometheus linter failed for ConfigMap '%s' key '%s': %v", configmap.Name, key, err),
+			})
 		}
 	}
+
+	if len(violations) > 0 {
+		return violations
+	}
 	return nil
 }
 
@@ -20,6 +20,8 @@ import (
 	"testing"
 
 	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var (
@@ -76,3 +78,29 @@ func TestInvalidSyntax(t *testing.T) {
 		t.Error("Expecting invalid promql to be disallowed")
 	}
 }
+
+func TestAllInvalidKeysReported(t *testing.T) {
+	configmap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-rules", Labels: map[string]string{"role": "prometheus-rulefiles"}},
+		Data: map[string]string{
+			"b.rules":     invalidQuery,
+			"valid.rules": validQuery,
+			"a.rules":     invalidQuery,
+		},
+	}
+
+	err := admitConfigMap(configmap)
+	violations, ok := err.(Violations)
+	if !ok {
+		t.Fatalf("Expecting violations to be returned, got %v", err)
+	}
+	if len(violations) != 2 {
+		t.Fatalf("Expecting a violation per invalid key, got %v", violations)
+	}
+	if violations[0].Field != "data[a.rules]" || violations[1].Field != "data[b.rules]" {
+		t.Errorf("Expecting violations for each invalid key in order, got %v", violations)
+	}
+	if violations[0].RuleID != "prometheuslinter.syntax" {
+		t.Errorf("Unexpected rule ID %s", violations[0].RuleID)
+	}
+}
@@ -0,0 +1,282 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Perform the admission logic on the Ingress object
+//
+// The rules this enforces are:
+//  Ingresses served by an external controller (by default, GCE's default
+//  class) are disallowed, unless annotated as intended to be visible
+//  externally, with the same annotation as public Services
+//  Ingresses served by an internal controller are allowed
+//  Every host of an external Ingress must be covered by its TLS configuration
+//
+// The class is given by spec.ingressClassName, or the
+// kubernetes.io/ingress.class annotation. Controllers differ in which they
+// read (GKE's only reads the annotation), so an Ingress is external if either
+// names a class that isn't internal.
+
+type PublicIngressAdmissionController struct {
+	// Classes served by internal controllers. Defaults to gce-internal.
+	InternalClasses []string `yaml:"internalClasses" json:"internalClasses,omitempty"`
+	// The class of Ingresses without one. Defaults to gce, which is
+	// external.
+	DefaultClass string `yaml:"defaultClass" json:"defaultClass,omitempty"`
+	// The annotation marking an Ingress as intentionally external, and its
+	// values. Default to those of the gkepublicservice handler.
+	OptInAnnotation string   `yaml:"optInAnnotation" json:"optInAnnotation,omitempty"`
+	OptInValues     []string `yaml:"optInValues" json:"optInValues,omitempty"`
+	// Allow external Ingresses without TLS
+	AllowPlaintext bool `yaml:"allowPlaintext" json:"allowPlaintext,omitempty"`
+}
+
+const ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+// The parts of the extensions/v1beta1, networking.k8s.io/v1beta1 and
+// networking.k8s.io/v1 Ingress reviewed by the handler, which are common to
+// each version
+type ingress struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		IngressClassName *string `json:"ingressClassName"`
+		TLS              []struct {
+			Hosts []string `json:"hosts"`
+		} `json:"tls"`
+		Rules []struct {
+			Host string `json:"host"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+var ingressResources = []metav1.GroupVersionResource{
+	{Group: "extensions", Version: "v1beta1", Resource: "ingresses"},
+	{Group: "networking.k8s.io", Version: "v1beta1", Resource: "ingresses"},
+	{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"},
+}
+
+func init() {
+	RegisterHandlerFactory(HandlerFactory{
+		Name:        "publicingress",
+		Description: "Rejects Ingresses served by an external controller unless annotated as intentionally external, and requires TLS for their hosts.",
+		DefaultRules: []MatchRule{{
+			Operations:  []v1beta1.Operation{v1beta1.Create, v1beta1.Update},
+			APIGroups:   []string{"extensions", "networking.k8s.io"},
+			APIVersions: []string{"v1beta1", "v1"},
+			Resources:   []string{"ingresses"},
+		}},
+		DisabledByDefault: true,
+		New:               func() AdmissionReviewHandler { return &PublicIngressAdmissionController{} },
+	})
+}
+
+func (g *PublicIngressAdmissionController) SetParameters(decode func(into interface{}) error) error {
+	if err := decode(g); err != nil {
+		return err
+	}
+	if g.OptInAnnotation != "" && len(validation.IsQualifiedName(g.OptInAnnotation)) > 0 {
+		return fmt.Errorf("invalid optInAnnotation '%s'", g.OptInAnnotation)
+	}
+	return nil
+}
+
+func (g *PublicIngressAdmissionController) Admit(ar *v1beta1.AdmissionReview) error {
+	return g.Review(context.Background(), ar).Err()
+}
+
+func (g *PublicIngressAdmissionController) Review(ctx context.Context, ar *v1beta1.AdmissionReview) *AdmissionResult {
+	ing, err := extractIngress(ar)
+	if err != nil {
+		return resultFromError(err)
+	}
+
+	level.Debug(LoggerFrom(ctx)).Log("msg", "Reviewing ingress", "classes", strings.Join(g.classes(ing), ","))
+	return resultFromError(g.admitIngress(ing))
+}
+
+// Only the Ingress's name, annotations and spec are reviewed
+func (g *PublicIngressAdmissionController) CacheContent(ar *v1beta1.AdmissionReview) ([]byte, bool) {
+	ing, err := extractIngress(ar)
+	if err != nil {
+		return nil, false
+	}
+
+	content, err := json.Marshal([]interface{}{ing.Name, ing.Annotations, ing.Spec})
+	return content, err == nil
+}
+
+// the classes the Ingress names, or the default class if it names none
+func (g *PublicIngressAdmissionController) classes(ing *ingress) []string {
+	var classes []string
+	if ing.Spec.IngressClassName != nil && *ing.Spec.IngressClassName != "" {
+		classes = append(classes, *ing.Spec.IngressClassName)
+	}
+	if class, found := ing.Annotations[ingressClassAnnotation]; found && class != "" {
+		classes = append(classes, class)
+	}
+	if len(classes) > 0 {
+		return classes
+	}
+	if g.DefaultClass == "" {
+		return []string{"gce"}
+	}
+	return []string{g.DefaultClass}
+}
+
+// the first of the Ingress's classes that isn't internal, if any
+func (g *PublicIngressAdmissionController) externalClass(ing *ingress) (string, bool) {
+	for _, class := range g.classes(ing) {
+		if !contains(g.internalClasses(), class) {
+			return class, true
+		}
+	}
+	return "", false
+}
+
+func (g *PublicIngressAdmissionController) internalClasses() []string {
+	if len(g.InternalClasses) == 0 {
+		return []string{"gce-internal"}
+	}
+	return g.InternalClasses
+}
+
+func (g *PublicIngressAdmissionController) optInAnnotation() string {
+	if g.OptInAnnotation == "" {
+		return defaultOptInAnnotation
+	}
+	return g.OptInAnnotation
+}
+
+func (g *PublicIngressAdmissionController) optInValues() []string {
+	if len(g.OptInValues) == 0 {
+		return []string{"External"}
+	}
+	return g.OptInValues
+}
+
+func (g *PublicIngressAdmissionController) admitIngress(ing *ingress) error {
+	class, external := g.externalClass(ing)
+	if !external {
+		return nil
+	}
+
+	var violations Violations
+	annotation := g.optInAnnotation()
+	annotations := field.NewPath("metadata", "annotations")
+	if v, found := ing.Annotations[annotation]; !found {
+		violations = append(violations, Violation{
+			Field:   annotations.Key(annotation).String(),
+			RuleID:  "publicingress.opt-in",
+			Message: fmt.Sprintf("The ingress '%s' is public (class '%s'), and so disallowed without the explicit '%s' annotation.", ing.Name, class, annotation),
+		})
+	} else if !containsFold(g.optInValues(), v) {
+		violations = append(violations, Violation{
+			Field:   annotations.Key(annotation).String(),
+			RuleID:  "publicingress.opt-in-value",
+			Message: fmt.Sprintf("The ingress '%s' is public, and the '%s' annotation must be '%s' to allow it, not '%s'.", ing.Name, annotation, strings.Join(g.optInValues(), "' or '"), v),
+		})
+	}
+
+	if !g.AllowPlaintext {
+		violations = append(violations, ingressTLSViolations(ing)...)
+	}
+
+	if len(violations) > 0 {
+		return violations
+	}
+	return nil
+}
+
+// every host of the Ingress must be covered by a TLS entry. An entry without
+// hosts covers every host, and rules without a host need such an entry.
+func ingressTLSViolations(ing *ingress) Violations {
+	var tlsHosts []string
+	coversAll := false
+	for _, tls := range ing.Spec.TLS {
+		if len(tls.Hosts) == 0 {
+			coversAll = true
+		}
+		tlsHosts = append(tlsHosts, tls.Hosts...)
+	}
+	if len(ing.Spec.Rules) == 0 && len(ing.Spec.TLS) == 0 {
+		return Violations{{
+			Field:   field.NewPath("spec", "tls").String(),
+			RuleID:  "publicingress.tls",
+			Message: fmt.Sprintf("The ingress '%s' is public, and must be configured with TLS.", ing.Name),
+		}}
+	}
+
+	var violations Violations
+	for i, rule := range ing.Spec.Rules {
+		if coversAll || (rule.Host != "" && hostCovered(rule.Host, tlsHosts)) {
+			continue
+		}
+		host := rule.Host
+		if host == "" {
+			host = "*"
+		}
+		violations = append(violations, Violation{
+			Field:   field.NewPath("spec", "rules").Index(i).Child("host").String(),
+			RuleID:  "publicingress.tls",
+			Message: fmt.Sprintf("The host '%s' of public ingress '%s' must be configured with TLS.", host, ing.Name),
+		})
+	}
+	return violations
+}
+
+// whether the host matches one of the TLS hosts, which may be wildcards
+func hostCovered(host string, tlsHosts []string) bool {
+	for _, h := range tlsHosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+		if strings.HasPrefix(h, "*.") {
+			suffix := h[1:]
+			if i := strings.Index(host, "."); i > 0 && strings.EqualFold(host[i:], suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fetch the Ingress object out of the AdmissionReview
+func extractIngress(ar *v1beta1.AdmissionReview) (*ingress, error) {
+	found := false
+	for _, resource := range ingressResources {
+		if ar.Request.Resource == resource {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("expect resource to be ingresses, not %s", ar.Request.Resource)
+	}
+
+	ing := ingress{}
+	err := json.Unmarshal(ar.Request.Object.Raw, &ing)
+	return &ing, err
+}
@@ -0,0 +1,117 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func ingressReview(t *testing.T, version string, object string) *v1beta1.AdmissionReview {
+	var ing map[string]interface{}
+	if err := json.Unmarshal([]byte(object), &ing); err != nil {
+		t.Fatal(err)
+	}
+	ing["metadata"] = map[string]interface{}{"name": "test-ingress", "namespace": "default", "annotations": ing["annotations"]}
+	delete(ing, "annotations")
+	raw, _ := json.Marshal(ing)
+
+	return &v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+		Resource:  metav1.GroupVersionResource{Group: "networking.k8s.io", Version: version, Resource: "ingresses"},
+		Namespace: "default",
+		Operation: v1beta1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+func ingressRuleIDs(t *testing.T, handler *PublicIngressAdmissionController, ar *v1beta1.AdmissionReview) []string {
+	result := handler.Review(context.Background(), ar)
+	var ids []string
+	for _, v := range result.Violations {
+		ids = append(ids, v.RuleID)
+	}
+	if result.Allowed != (len(ids) == 0) {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	return ids
+}
+
+func TestPublicIngress(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		object  string
+		want    []string
+	}{
+		{"default class without annotation", "v1", `{"spec":{"tls":[{"hosts":["a.example.com"]}],"rules":[{"host":"a.example.com"}]}}`, []string{"publicingress.opt-in"}},
+		{"default class opted in", "v1", `{"annotations":{"gke/load-balancer-type":"external"},"spec":{"tls":[{"hosts":["a.example.com"]}],"rules":[{"host":"a.example.com"}]}}`, nil},
+		{"wrong opt-in value", "v1", `{"annotations":{"gke/load-balancer-type":"yes"},"spec":{"tls":[{}],"rules":[{"host":"a.example.com"}]}}`, []string{"publicingress.opt-in-value"}},
+		{"internal class annotation", "v1beta1", `{"annotations":{"kubernetes.io/ingress.class":"gce-internal"},"spec":{"rules":[{"host":"a.example.com"}]}}`, nil},
+		{"internal class name", "v1", `{"spec":{"ingressClassName":"gce-internal","rules":[{"host":"a.example.com"}]}}`, nil},
+		{"external class name", "v1", `{"annotations":{"kubernetes.io/ingress.class":"gce-internal"},"spec":{"ingressClassName":"gce","tls":[{}]}}`, []string{"publicingress.opt-in"}},
+		{"external class annotation", "v1", `{"annotations":{"kubernetes.io/ingress.class":"gce"},"spec":{"ingressClassName":"gce-internal","tls":[{}]}}`, []string{"publicingress.opt-in"}},
+		{"both internal", "v1", `{"annotations":{"kubernetes.io/ingress.class":"gce-internal"},"spec":{"ingressClassName":"gce-internal","rules":[{"host":"a.example.com"}]}}`, nil},
+		{"unknown class is external", "v1", `{"spec":{"ingressClassName":"nginx","tls":[{}]}}`, []string{"publicingress.opt-in"}},
+		{"host without TLS", "v1", `{"annotations":{"gke/load-balancer-type":"External"},"spec":{"tls":[{"hosts":["a.example.com"]}],"rules":[{"host":"a.example.com"},{"host":"b.example.com"}]}}`, []string{"publicingress.tls"}},
+		{"wildcard TLS host", "v1", `{"annotations":{"gke/load-balancer-type":"External"},"spec":{"tls":[{"hosts":["*.example.com"]}],"rules":[{"host":"a.example.com"},{"host":"b.a.example.com"}]}}`, []string{"publicingress.tls"}},
+		{"hostless rule", "v1", `{"annotations":{"gke/load-balancer-type":"External"},"spec":{"tls":[{"hosts":["a.example.com"]}],"rules":[{}]}}`, []string{"publicingress.tls"}},
+		{"default backend without TLS", "v1", `{"annotations":{"gke/load-balancer-type":"External"},"spec":{"defaultBackend":{}}}`, []string{"publicingress.tls"}},
+		{"both", "v1", `{"spec":{"rules":[{"host":"a.example.com"}]}}`, []string{"publicingress.opt-in", "publicingress.tls"}},
+	}
+
+	for _, test := range tests {
+		ids := ingressRuleIDs(t, &PublicIngressAdmissionController{}, ingressReview(t, test.version, test.object))
+		if len(ids) != len(test.want) {
+			t.Errorf("%s: expected violations %v, got %v", test.name, test.want, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != test.want[i] {
+				t.Errorf("%s: expected violations %v, got %v", test.name, test.want, ids)
+			}
+		}
+	}
+}
+
+func TestPublicIngressParameters(t *testing.T) {
+	handler := &PublicIngressAdmissionController{}
+	params := "internalClasses: [nginx-internal]\ndefaultClass: nginx-internal\nallowPlaintext: true\n"
+	if err := handler.SetParameters(yamlDecoder(params)); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := ingressRuleIDs(t, handler, ingressReview(t, "v1", `{"spec":{"rules":[{"host":"a.example.com"}]}}`)); len(ids) != 0 {
+		t.Errorf("Expecting the default class to be internal, got %v", ids)
+	}
+	if ids := ingressRuleIDs(t, handler, ingressReview(t, "v1", `{"annotations":{"gke/load-balancer-type":"External"},"spec":{"ingressClassName":"gce","rules":[{"host":"a.example.com"}]}}`)); len(ids) != 0 {
+		t.Errorf("Expecting plaintext to be allowed, got %v", ids)
+	}
+
+	if err := (&PublicIngressAdmissionController{}).SetParameters(yamlDecoder("optInAnnotation: 'not valid!'")); err == nil {
+		t.Error("Expecting an invalid opt-in annotation to be rejected")
+	}
+}
+
+func TestPublicIngressRejectsOtherResources(t *testing.T) {
+	ar := UnmarshalAR(unannotatedJson)
+	if err := (&PublicIngressAdmissionController{}).Admit(ar); err == nil {
+		t.Error("Expecting a Service to be rejected")
+	}
+}
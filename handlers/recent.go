@@ -0,0 +1,204 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The /debug/decisions endpoint, listing recent denials and warnings so that
+// users can find out why a request was rejected without access to the logs.
+// Only the object's metadata is kept, with annotations that may contain the
+// whole object (and so any secrets in it) redacted.
+
+const (
+	RecentDecisionsPath    = "/debug/decisions"
+	DefaultRecentDecisions = 500
+)
+
+// Annotations whose values are replaced before a decision is kept
+var RedactedAnnotations = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+}
+
+const redacted = "<redacted>"
+
+type RecentDecision struct {
+	Time        time.Time                   `json:"time"`
+	UID         types.UID                   `json:"uid"`
+	Handler     string                      `json:"handler"`
+	Resource    metav1.GroupVersionResource `json:"resource"`
+	Kind        string                      `json:"kind"`
+	Namespace   string                      `json:"namespace,omitempty"`
+	Name        string                      `json:"name,omitempty"`
+	Operation   string                      `json:"operation"`
+	User        string                      `json:"user"`
+	Groups      []string                    `json:"groups,omitempty"`
+	Enforcement EnforcementMode             `json:"enforcement"`
+	Outcome     DecisionOutcome             `json:"outcome"`
+	Message     string                      `json:"message,omitempty"`
+	Violations  Violations                  `json:"violations,omitempty"`
+	Warnings    []string                    `json:"warnings,omitempty"`
+	Metadata    *metav1.ObjectMeta          `json:"metadata,omitempty"`
+}
+
+type decisionRing struct {
+	lock    sync.Mutex
+	entries []RecentDecision
+	// where the next entry is written, once the ring is full
+	next int
+}
+
+var recentDecisions = &decisionRing{entries: make([]RecentDecision, 0, DefaultRecentDecisions)}
+
+// Keep the given number of recent denials and warnings. 0 keeps none.
+func SetRecentDecisionsSize(size int) {
+	recent := recentDecisions.list()
+	if len(recent) > size {
+		recent = recent[:size]
+	}
+
+	ring := &decisionRing{entries: make([]RecentDecision, 0, size)}
+	for i := len(recent) - 1; i >= 0; i-- {
+		ring.add(recent[i])
+	}
+
+	recentDecisions.lock.Lock()
+	defer recentDecisions.lock.Unlock()
+	recentDecisions.entries, recentDecisions.next = ring.entries, ring.next
+}
+
+func (r *decisionRing) record(d *Decision) {
+	if d.Outcome == OutcomeAllowed || d.Outcome == OutcomeExempt {
+		return
+	}
+
+	r.add(RecentDecision{
+		Time:        d.Time,
+		UID:         d.UID,
+		Handler:     d.Handler,
+		Resource:    d.Resource,
+		Kind:        d.Kind,
+		Namespace:   d.Namespace,
+		Name:        d.Name,
+		Operation:   string(d.Operation),
+		User:        d.User,
+		Groups:      d.Groups,
+		Enforcement: d.Enforcement,
+		Outcome:     d.Outcome,
+		Message:     d.Message,
+		Violations:  d.Violations,
+		Warnings:    d.Warnings,
+		Metadata:    redactedMetadata(d),
+	})
+}
+
+func (r *decisionRing) add(entry RecentDecision) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, entry)
+		return
+	}
+	if len(r.entries) == 0 {
+		return
+	}
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % len(r.entries)
+}
+
+// list the entries, most recent first
+func (r *decisionRing) list() []RecentDecision {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	list := make([]RecentDecision, 0, len(r.entries))
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		list = append(list, r.entries[(r.next+i)%len(r.entries)])
+	}
+	return list
+}
+
+func redactedMetadata(d *Decision) *metav1.ObjectMeta {
+	raw := d.Object
+	if len(raw) == 0 {
+		raw = d.OldObject
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+
+	var object struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil
+	}
+
+	meta := object.Metadata
+	if meta.Annotations != nil {
+		annotations := make(map[string]string, len(meta.Annotations))
+		for k, v := range meta.Annotations {
+			if contains(RedactedAnnotations, k) {
+				v = redacted
+			}
+			annotations[k] = v
+		}
+		meta.Annotations = annotations
+	}
+	return &meta
+}
+
+// List recent decisions, most recent first, filtered by the namespace, user
+// and handler query parameters and limited to limit entries
+func serveRecentDecisions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := -1
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	decisions := []RecentDecision{}
+	for _, d := range recentDecisions.list() {
+		if limit >= 0 && len(decisions) >= limit {
+			break
+		}
+		if matchQuery(query["namespace"], d.Namespace) && matchQuery(query["user"], d.User) && matchQuery(query["handler"], d.Handler) {
+			decisions = append(decisions, d)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(decisions); err != nil {
+		level.Error(baseLogger()).Log("msg", "Unable to encode recent decisions", "err", err)
+	}
+}
+
+func matchQuery(values []string, value string) bool {
+	return len(values) == 0 || contains(values, value)
+}
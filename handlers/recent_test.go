@@ -0,0 +1,105 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getRecentDecisions(t *testing.T, query string) []RecentDecision {
+	req := httptest.NewRequest("GET", RecentDecisionsPath+query, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	requireAdmin(serveRecentDecisions)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body)
+	}
+	var decisions []RecentDecision
+	if err := json.Unmarshal(w.Body.Bytes(), &decisions); err != nil {
+		t.Fatalf("Unable to unmarshal decisions: %v", err)
+	}
+	return decisions
+}
+
+func TestRecentDecisions(t *testing.T) {
+	SetAdminTokens([]string{"secret"})
+	defer SetAdminTokens(nil)
+	SetRecentDecisionsSize(0)
+	SetRecentDecisionsSize(3)
+	defer SetRecentDecisionsSize(DefaultRecentDecisions)
+
+	for i := 0; i < 5; i++ {
+		recordDecision(&Decision{
+			Handler:   "gkepublicservice",
+			Namespace: fmt.Sprintf("ns-%d", i%2),
+			Name:      fmt.Sprintf("service-%d", i),
+			User:      "kubernetes-admin",
+			Outcome:   OutcomeDenied,
+		})
+	}
+	recordDecision(&Decision{Handler: "gkepublicservice", Name: "allowed", Outcome: OutcomeAllowed})
+
+	decisions := getRecentDecisions(t, "")
+	if len(decisions) != 3 || decisions[0].Name != "service-4" || decisions[2].Name != "service-2" {
+		t.Errorf("Expecting the 3 most recent denials, most recent first, got %+v", decisions)
+	}
+
+	if decisions := getRecentDecisions(t, "?namespace=ns-1&user=kubernetes-admin"); len(decisions) != 1 || decisions[0].Name != "service-3" {
+		t.Errorf("Expecting decisions to be filtered, got %+v", decisions)
+	}
+	if decisions := getRecentDecisions(t, "?handler=prometheuslinter"); len(decisions) != 0 {
+		t.Errorf("Expecting no decisions for another handler, got %+v", decisions)
+	}
+	if decisions := getRecentDecisions(t, "?limit=1"); len(decisions) != 1 {
+		t.Errorf("Expecting decisions to be limited, got %+v", decisions)
+	}
+
+	SetRecentDecisionsSize(2)
+	if decisions := getRecentDecisions(t, ""); len(decisions) != 2 || decisions[0].Name != "service-4" {
+		t.Errorf("Expecting the most recent decisions to be kept on resize, got %+v", decisions)
+	}
+}
+
+func TestRecentDecisionRedacted(t *testing.T) {
+	SetAdminTokens([]string{"secret"})
+	defer SetAdminTokens(nil)
+	SetRecentDecisionsSize(0)
+	SetRecentDecisionsSize(DefaultRecentDecisions)
+
+	recordDecision(&Decision{
+		Handler: "gkepublicservice",
+		Outcome: OutcomeWarned,
+		Object: json.RawMessage(`{"metadata":{"name":"test-service","labels":{"app":"test"},"annotations":{
+			"kubectl.kubernetes.io/last-applied-configuration":"{\"data\":{\"password\":\"hunter2\"}}",
+			"cloud.google.com/load-balancer-type":"internal"}},"data":{"password":"hunter2"}}`),
+	})
+
+	decisions := getRecentDecisions(t, "")
+	if len(decisions) != 1 || decisions[0].Metadata == nil {
+		t.Fatalf("Expecting the decision's metadata, got %+v", decisions)
+	}
+	meta := decisions[0].Metadata
+	if meta.Labels["app"] != "test" || meta.Annotations["cloud.google.com/load-balancer-type"] != "internal" {
+		t.Errorf("Expecting labels and annotations to be kept, got %+v", meta)
+	}
+	if meta.Annotations["kubectl.kubernetes.io/last-applied-configuration"] != redacted {
+		t.Errorf("Expecting the last applied configuration to be redacted, got %+v", meta)
+	}
+}
@@ -0,0 +1,86 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Handlers that can be enabled by name, from the command line or the
+// configuration file. Built-in handlers register themselves in their init(),
+// and third-party handlers can do the same.
+
+type HandlerFactory struct {
+	// Unique name, used to enable the handler
+	Name string
+	// A summary of what the handler enforces
+	Description string
+	// The path the handler is served on, unless configured otherwise
+	DefaultPath string
+	// The requests the handler is run for from the dispatch endpoint, unless
+	// configured otherwise
+	DefaultRules []MatchRule
+	// Only run the handler when it's enabled explicitly, in the
+	// configuration file or with -enable-handlers
+	DisabledByDefault bool
+	// The handler returns patches, so it's only served on its own path, for a
+	// MutatingWebhookConfiguration, and never from the validating dispatch
+	// endpoint
+	Mutating bool
+	// Construct a new instance of the handler, with its default parameters
+	New func() AdmissionReviewHandler
+}
+
+var (
+	factoriesLock sync.RWMutex
+	factories     = map[string]HandlerFactory{}
+)
+
+// Make a handler available by name. Panics if the name is already in use.
+func RegisterHandlerFactory(factory HandlerFactory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	if _, found := factories[factory.Name]; found {
+		panic(fmt.Sprintf("handler '%s' is already registered", factory.Name))
+	}
+	if factory.DefaultPath == "" {
+		factory.DefaultPath = "/" + factory.Name
+	}
+	factories[factory.Name] = factory
+}
+
+func GetHandlerFactory(name string) (HandlerFactory, bool) {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	factory, found := factories[name]
+	return factory, found
+}
+
+// Every registered factory, ordered by name
+func GetHandlerFactories() []HandlerFactory {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	list := make([]HandlerFactory, 0, len(factories))
+	for _, factory := range factories {
+		list = append(list, factory)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,50 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestBuiltinFactoriesRegistered(t *testing.T) {
+	var names []string
+	for _, factory := range GetHandlerFactories() {
+		names = append(names, factory.Name)
+	}
+	if !sort.StringsAreSorted(names) || !contains(names, "gkepublicservice") || !contains(names, "prometheuslinter") {
+		t.Fatalf("Expecting built-in handlers to be registered in name order, got %v", names)
+	}
+
+	factory, found := GetHandlerFactory("gkepublicservice")
+	if !found {
+		t.Fatal("Expecting gkepublicservice to be registered")
+	}
+	if factory.DefaultPath != "/gkepublicservice" || factory.Description == "" || len(factory.DefaultRules) == 0 {
+		t.Errorf("Unexpected factory %+v", factory)
+	}
+	if _, ok := factory.New().(*GkeServiceAdmissionController); !ok {
+		t.Error("Expecting factory to construct a GkeServiceAdmissionController")
+	}
+}
+
+func TestDuplicateFactoryPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expecting duplicate registration to panic")
+		}
+	}()
+	RegisterHandlerFactory(HandlerFactory{Name: "gkepublicservice"})
+}
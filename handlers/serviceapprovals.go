@@ -0,0 +1,61 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/benburry/k8s-admission-webhooks/approval"
+)
+
+// Public services need an approval signed by one of the keys, in place of the
+// opt-in annotation's usual value. The approval names the service's namespace
+// and name, and the ports it may expose, and expires. Approvals are minted
+// with the mint-approval command.
+type ApprovalPolicy struct {
+	Keys []approval.KeyOptions `yaml:"keys" json:"keys"`
+
+	keys approval.Keys
+}
+
+// read the keys, so that a missing key file is found with the configuration
+func (p *ApprovalPolicy) load() error {
+	if len(p.Keys) == 0 {
+		return fmt.Errorf("at least one key is required")
+	}
+	keys, err := approval.LoadKeys(p.Keys)
+	p.keys = keys
+	return err
+}
+
+func (p *ApprovalPolicy) verify(service *corev1.Service, token string) error {
+	claims, err := p.keys.Verify(token, time.Now())
+	if err != nil {
+		return err
+	}
+	if claims.Namespace != service.Namespace || claims.Name != service.Name {
+		return fmt.Errorf("the approval is for service '%s' in namespace '%s'", claims.Name, claims.Namespace)
+	}
+	for _, port := range service.Spec.Ports {
+		p := approval.Port(port.Port, string(port.Protocol))
+		if !contains(claims.Ports, p) {
+			return fmt.Errorf("port %s isn't approved", p)
+		}
+	}
+	return nil
+}
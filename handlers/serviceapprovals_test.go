@@ -0,0 +1,137 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/benburry/k8s-admission-webhooks/approval"
+)
+
+// write the HMAC secret approvals are signed with to a file
+func approvalSecret(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "approvals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretFile := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("a-shared-secret-of-some-length"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return secretFile, func() { os.RemoveAll(dir) }
+}
+
+func TestApprovals(t *testing.T) {
+	secretFile, cleanup := approvalSecret(t)
+	defer cleanup()
+
+	g := serviceParameters(t, fmt.Sprintf(`approvals: {keys: [{id: security, hmacSecretFile: %s}]}`, secretFile))
+	key := &approval.SigningKey{ID: "security", HMACSecret: []byte("a-shared-secret-of-some-length")}
+	sign := func(claims approval.Claims) string {
+		token, err := key.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	expires := time.Now().Add(time.Hour).Unix()
+
+	service := UnmarshalService(unannotatedJson)
+	for _, test := range []struct {
+		token   string
+		allowed bool
+	}{
+		{sign(approval.Claims{Namespace: "default", Name: "test-service", Ports: []string{"1024/TCP", "443/TCP"}, Expires: expires}), true},
+		{"External", false},
+		{sign(approval.Claims{Namespace: "default", Name: "other-service", Ports: []string{"1024/TCP"}, Expires: expires}), false},
+		{sign(approval.Claims{Namespace: "default", Name: "test-service", Ports: []string{"443/TCP"}, Expires: expires}), false},
+		{sign(approval.Claims{Namespace: "default", Name: "test-service", Ports: []string{"1024/TCP"}, Expires: time.Now().Add(-time.Minute).Unix()}), false},
+	} {
+		service.Annotations["gke/load-balancer-type"] = test.token
+		err := g.admitService(service)
+		if test.allowed && err != nil {
+			t.Errorf("Expecting token %s to be allowed, got %v", test.token, err)
+		}
+		if violations, ok := err.(Violations); !test.allowed && (!ok || len(violations) != 1 || violations[0].RuleID != "gkepublicservice.approval") {
+			t.Errorf("Expecting token %s to be refused, got %v", test.token, err)
+		}
+	}
+
+	// approvals aren't needed for internal services
+	if err := g.admitService(UnmarshalService(annotatedJson)); err != nil {
+		t.Errorf("Expecting an internal service to be allowed, got %v", err)
+	}
+	// nor are their decisions cached
+	if _, cacheable := g.CacheContent(UnmarshalAR(unannotatedJson)); cacheable {
+		t.Error("Expecting decisions needing approvals not to be cached")
+	}
+
+	for _, parameters := range []string{`approvals: {}`, `approvals: {keys: [{id: security, hmacSecretFile: /nonexistent}]}`} {
+		if err := (&GkeServiceAdmissionController{}).SetParameters(yamlDecoder(parameters)); err == nil {
+			t.Errorf("Expecting parameters %s to be refused", parameters)
+		}
+	}
+}
+
+func TestApprovedNodePort(t *testing.T) {
+	secretFile, cleanup := approvalSecret(t)
+	defer cleanup()
+
+	g := serviceParameters(t, fmt.Sprintf(`{nodePorts: {mode: optIn}, approvals: {keys: [{id: security, hmacSecretFile: %s}]}}`, secretFile))
+	service := nodePortService()
+	service.Annotations["gke/load-balancer-type"] = "External"
+	if err := g.admitService(service); err == nil {
+		t.Error("Expecting a NodePort service without an approval to be disallowed")
+	}
+
+	key := &approval.SigningKey{ID: "security", HMACSecret: []byte("a-shared-secret-of-some-length")}
+	token, _ := key.Sign(approval.Claims{Namespace: "default", Name: "test-service", Ports: []string{"1024/TCP"}, Expires: time.Now().Add(time.Hour).Unix()})
+	service.Annotations["gke/load-balancer-type"] = token
+	if err := g.admitService(service); err != nil {
+		t.Errorf("Expecting an approved NodePort service to be allowed, got %v", err)
+	}
+}
+
+func TestExpiredApprovalUpdates(t *testing.T) {
+	secretFile, cleanup := approvalSecret(t)
+	defer cleanup()
+
+	g := serviceParameters(t, fmt.Sprintf(`approvals: {keys: [{id: security, hmacSecretFile: %s}]}`, secretFile))
+	key := &approval.SigningKey{ID: "security", HMACSecret: []byte("a-shared-secret-of-some-length")}
+	expired, _ := key.Sign(approval.Claims{Namespace: "default", Name: "test-service", Ports: []string{"1024/TCP"}, Expires: time.Now().Add(-time.Hour).Unix()})
+
+	old := UnmarshalService(unannotatedJson)
+	old.Annotations["gke/load-balancer-type"] = expired
+
+	// updates not increasing the exposure don't need a current approval
+	service := old.DeepCopy()
+	service.Labels = map[string]string{"team": "web"}
+	if ids := reviewRuleIDs(g, updateReview(t, old, service)); len(ids) != 0 {
+		t.Errorf("Expecting an approved service to be updated after the approval expired, got %v", ids)
+	}
+
+	// but escalations do
+	service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Port: 443})
+	if ids := reviewRuleIDs(g, updateReview(t, old, service)); len(ids) != 2 || ids[1] != "gkepublicservice.approval" {
+		t.Errorf("Expecting a port added with an expired approval to be disallowed, got %v", ids)
+	}
+}
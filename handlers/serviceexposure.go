@@ -0,0 +1,353 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Rules for the ways a Service can be exposed outside the cluster other than
+// through a LoadBalancer: NodePort services, which are reachable on every
+// node, and spec.externalIPs, which can also be used to intercept traffic to
+// other addresses (CVE-2020-8554). Also, the source ranges allowed to reach
+// an external LoadBalancer, and the ports it may expose.
+
+type NodePortMode string
+
+const (
+	// NodePort services are allowed
+	NodePortAllow NodePortMode = "allow"
+	// NodePort services need the opt-in annotation, as for a public
+	// LoadBalancer
+	NodePortOptIn NodePortMode = "optIn"
+	// NodePort services are disallowed
+	NodePortDeny NodePortMode = "deny"
+)
+
+type NodePortPolicy struct {
+	// Defaults to allow
+	Mode NodePortMode `yaml:"mode" json:"mode,omitempty"`
+	// If given, node ports requested explicitly in spec.ports must be
+	// within one of these ranges, e.g. "30000-30099" or "30080"
+	Ranges []string `yaml:"ranges" json:"ranges,omitempty"`
+}
+
+type ExternalIPPolicy struct {
+	// The CIDRs each namespace's services may use as external IPs, with "*"
+	// applying to every namespace. External IPs are disallowed in any other
+	// namespace.
+	Allowed map[string][]string `yaml:"allowed" json:"allowed,omitempty"`
+}
+
+// External load balancers must restrict the addresses that can reach them,
+// with spec.loadBalancerSourceRanges or the source ranges annotation. Ranges
+// open to the whole internet need the justification annotation.
+type SourceRangePolicy struct {
+	// Defaults to gke/world-open-justification
+	JustificationAnnotation string `yaml:"justificationAnnotation" json:"justificationAnnotation,omitempty"`
+}
+
+// External load balancers may only expose the allowed ports. Each entry is a
+// port or range of ports, optionally with a protocol, e.g. "443/TCP",
+// "8000-8099" or "53/UDP". Entries without a protocol allow any.
+type PortPolicy struct {
+	Allowed []string `yaml:"allowed" json:"allowed,omitempty"`
+	// The ports allowed in each namespace, replacing Allowed there
+	Namespaces map[string][]string `yaml:"namespaces" json:"namespaces,omitempty"`
+}
+
+const (
+	sourceRangesAnnotation         = "service.beta.kubernetes.io/load-balancer-source-ranges"
+	defaultJustificationAnnotation = "gke/world-open-justification"
+)
+
+func (p *SourceRangePolicy) justificationAnnotation() string {
+	if p.JustificationAnnotation == "" {
+		return defaultJustificationAnnotation
+	}
+	return p.JustificationAnnotation
+}
+
+func (p *NodePortPolicy) validate() error {
+	switch p.Mode {
+	case "", NodePortAllow, NodePortOptIn, NodePortDeny:
+	default:
+		return fmt.Errorf("mode must be one of '%s', '%s' or '%s', not '%s'", NodePortAllow, NodePortOptIn, NodePortDeny, p.Mode)
+	}
+	for _, r := range p.Ranges {
+		if _, _, err := parsePortRange(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *ExternalIPPolicy) validate() error {
+	for namespace, cidrs := range p.Allowed {
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("allowed[%s]: invalid CIDR '%s'", namespace, cidr)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *PortPolicy) validate() error {
+	for _, entry := range p.Allowed {
+		if _, _, _, err := parsePortEntry(entry); err != nil {
+			return fmt.Errorf("allowed: %v", err)
+		}
+	}
+	for namespace, entries := range p.Namespaces {
+		for _, entry := range entries {
+			if _, _, _, err := parsePortEntry(entry); err != nil {
+				return fmt.Errorf("namespaces[%s]: %v", namespace, err)
+			}
+		}
+	}
+	return nil
+}
+
+// the ports allowed in the namespace
+func (p *PortPolicy) allowed(namespace string) []string {
+	if entries, found := p.Namespaces[namespace]; found {
+		return entries
+	}
+	return p.Allowed
+}
+
+// parse a port range with an optional protocol, "low-high/protocol"
+func parsePortEntry(entry string) (int, int, corev1.Protocol, error) {
+	parts := strings.SplitN(entry, "/", 2)
+	var protocol corev1.Protocol
+	if len(parts) == 2 {
+		protocol = corev1.Protocol(strings.ToUpper(strings.TrimSpace(parts[1])))
+		switch protocol {
+		case corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.Protocol("SCTP"):
+		default:
+			return 0, 0, "", fmt.Errorf("invalid protocol in '%s'", entry)
+		}
+	}
+	low, high, err := parsePortRange(parts[0])
+	return low, high, protocol, err
+}
+
+// parse a port range, "low-high", or a single port
+func parsePortRange(r string) (int, int, error) {
+	parts := strings.SplitN(r, "-", 2)
+	low, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	high := low
+	if err == nil && len(parts) == 2 {
+		high, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+	}
+	if err != nil || low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range '%s'", r)
+	}
+	return low, high, nil
+}
+
+// whether the service has the annotation marking it as intentionally external
+func (g *GkeServiceAdmissionController) optedIn(service *corev1.Service) bool {
+	v, found := service.Annotations[g.optInAnnotation()]
+	if found && g.Approvals != nil {
+		return g.Approvals.verify(service, v) == nil
+	}
+	return found && containsFold(g.optInValues(), v)
+}
+
+func (g *GkeServiceAdmissionController) admitNodePorts(service *corev1.Service) Violations {
+	if g.NodePorts == nil || (service.Spec.Type != corev1.ServiceTypeNodePort && service.Spec.Type != corev1.ServiceTypeLoadBalancer) {
+		return nil
+	}
+
+	var violations Violations
+	if service.Spec.Type == corev1.ServiceTypeNodePort {
+		switch g.NodePorts.Mode {
+		case NodePortDeny:
+			violations = append(violations, Violation{
+				Field:   field.NewPath("spec", "type").String(),
+				RuleID:  "gkepublicservice.nodeport",
+				Message: fmt.Sprintf("The service '%s' is a NodePort service, which is disallowed.", service.Name),
+			})
+		case NodePortOptIn:
+			if !g.optedIn(service) {
+				violations = append(violations, Violation{
+					Field:   field.NewPath("metadata", "annotations").Key(g.optInAnnotation()).String(),
+					RuleID:  "gkepublicservice.nodeport",
+					Message: fmt.Sprintf("The service '%s' is a NodePort service, reachable on every node, and so disallowed without the explicit '%s' annotation.", service.Name, g.optInAnnotation()),
+				})
+			}
+		}
+	}
+
+	if len(g.NodePorts.Ranges) == 0 {
+		return violations
+	}
+	for i, port := range service.Spec.Ports {
+		if port.NodePort == 0 || g.NodePorts.inRange(int(port.NodePort)) {
+			continue
+		}
+		violations = append(violations, Violation{
+			Field:   field.NewPath("spec", "ports").Index(i).Child("nodePort").String(),
+			RuleID:  "gkepublicservice.nodeport-range",
+			Message: fmt.Sprintf("The node port %d of service '%s' must be within %s.", port.NodePort, service.Name, strings.Join(g.NodePorts.Ranges, ", ")),
+		})
+	}
+	return violations
+}
+
+func (p *NodePortPolicy) inRange(port int) bool {
+	for _, r := range p.Ranges {
+		if low, high, err := parsePortRange(r); err == nil && port >= low && port <= high {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GkeServiceAdmissionController) admitExternalIPs(service *corev1.Service) Violations {
+	if g.ExternalIPs == nil {
+		return nil
+	}
+
+	allowed := append(append([]string{}, g.ExternalIPs.Allowed["*"]...), g.ExternalIPs.Allowed[service.Namespace]...)
+
+	var violations Violations
+	for i, ip := range service.Spec.ExternalIPs {
+		if ipInCIDRs(ip, allowed) {
+			continue
+		}
+		violations = append(violations, Violation{
+			Field:   field.NewPath("spec", "externalIPs").Index(i).String(),
+			RuleID:  "gkepublicservice.external-ips",
+			Message: fmt.Sprintf("The external IP '%s' of service '%s' is not allowed in namespace '%s'.", ip, service.Name, service.Namespace),
+		})
+	}
+	return violations
+}
+
+func ipInCIDRs(address string, cidrs []string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GkeServiceAdmissionController) admitSourceRanges(service *corev1.Service) Violations {
+	if g.SourceRanges == nil || service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return nil
+	}
+
+	type sourceRange struct {
+		field *field.Path
+		cidr  string
+	}
+	var ranges []sourceRange
+	for i, cidr := range service.Spec.LoadBalancerSourceRanges {
+		ranges = append(ranges, sourceRange{field.NewPath("spec", "loadBalancerSourceRanges").Index(i), cidr})
+	}
+	// the annotation is only used when the spec has no ranges
+	annotations := field.NewPath("metadata", "annotations")
+	if v, found := service.Annotations[sourceRangesAnnotation]; found && len(ranges) == 0 {
+		for _, cidr := range strings.Split(v, ",") {
+			ranges = append(ranges, sourceRange{annotations.Key(sourceRangesAnnotation), strings.TrimSpace(cidr)})
+		}
+	}
+
+	var violations Violations
+	worldOpen := false
+	for _, r := range ranges {
+		_, network, err := net.ParseCIDR(r.cidr)
+		if err != nil {
+			violations = append(violations, Violation{
+				Field:   r.field.String(),
+				RuleID:  "gkepublicservice.source-ranges-cidr",
+				Message: fmt.Sprintf("The source range '%s' of service '%s' is not a valid CIDR.", r.cidr, service.Name),
+			})
+			continue
+		}
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			worldOpen = true
+		}
+	}
+
+	if g.internal(service) {
+		return violations
+	}
+
+	justification := g.SourceRanges.justificationAnnotation()
+	if len(ranges) == 0 {
+		violations = append(violations, Violation{
+			Field:   field.NewPath("spec", "loadBalancerSourceRanges").String(),
+			RuleID:  "gkepublicservice.source-ranges",
+			Message: fmt.Sprintf("The service '%s' is public, and must restrict the addresses that can reach it with spec.loadBalancerSourceRanges.", service.Name),
+		})
+	} else if worldOpen && strings.TrimSpace(service.Annotations[justification]) == "" {
+		violations = append(violations, Violation{
+			Field:   annotations.Key(justification).String(),
+			RuleID:  "gkepublicservice.world-open",
+			Message: fmt.Sprintf("The service '%s' is open to the whole internet, which needs a reason in the '%s' annotation.", service.Name, justification),
+		})
+	}
+	return violations
+}
+
+func (g *GkeServiceAdmissionController) admitPorts(service *corev1.Service) Violations {
+	if g.Ports == nil || service.Spec.Type != corev1.ServiceTypeLoadBalancer || g.internal(service) {
+		return nil
+	}
+
+	allowed := g.Ports.allowed(service.Namespace)
+
+	var violations Violations
+	for i, port := range service.Spec.Ports {
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		if portAllowed(int(port.Port), protocol, allowed) {
+			continue
+		}
+		violations = append(violations, Violation{
+			Field:   field.NewPath("spec", "ports").Index(i).String(),
+			RuleID:  "gkepublicservice.port",
+			Message: fmt.Sprintf("The service '%s' is public, and may not expose port %d/%s in namespace '%s'.", service.Name, port.Port, protocol, service.Namespace),
+		})
+	}
+	return violations
+}
+
+func portAllowed(port int, protocol corev1.Protocol, entries []string) bool {
+	for _, entry := range entries {
+		low, high, p, err := parsePortEntry(entry)
+		if err == nil && port >= low && port <= high && (p == "" || p == protocol) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func nodePortService() *corev1.Service {
+	service := UnmarshalService(unannotatedJson)
+	service.Spec.Type = corev1.ServiceTypeNodePort
+	return service
+}
+
+func TestNodePortsAllowedByDefault(t *testing.T) {
+	service := nodePortService()
+	service.Spec.ExternalIPs = []string{"203.0.113.10"}
+	if err := defaultServicePolicy.admitService(service); err != nil {
+		t.Errorf("Expecting NodePort services and external IPs to be allowed by default, got %v", err)
+	}
+}
+
+func TestNodePortOptIn(t *testing.T) {
+	g := serviceParameters(t, `nodePorts: {mode: optIn}`)
+
+	service := nodePortService()
+	violations, ok := g.admitService(service).(Violations)
+	if !ok || len(violations) != 1 || violations[0].RuleID != "gkepublicservice.nodeport" {
+		t.Errorf("Expecting a NodePort service without the opt-in to be disallowed, got %v", violations)
+	}
+
+	service.Annotations["gke/load-balancer-type"] = "External"
+	if err := g.admitService(service); err != nil {
+		t.Errorf("Expecting a NodePort service with the opt-in to be allowed, got %v", err)
+	}
+
+	g = serviceParameters(t, `nodePorts: {mode: deny}`)
+	if err := g.admitService(service); err == nil {
+		t.Error("Expecting NodePort services to be disallowed")
+	}
+}
+
+func TestNodePortRanges(t *testing.T) {
+	g := serviceParameters(t, `nodePorts: {ranges: ["30000-30099", "31000"]}`)
+
+	service := nodePortService()
+	service.Spec.Ports = []corev1.ServicePort{{Port: 80, NodePort: 30080}, {Port: 81, NodePort: 31000}, {Port: 82}}
+	if err := g.admitService(service); err != nil {
+		t.Errorf("Expecting node ports within the ranges to be allowed, got %v", err)
+	}
+
+	service.Spec.Ports[1].NodePort = 32000
+	violations, ok := g.admitService(service).(Violations)
+	if !ok || len(violations) != 1 || violations[0].Field != "spec.ports[1].nodePort" || violations[0].RuleID != "gkepublicservice.nodeport-range" {
+		t.Errorf("Expecting the node port outside the ranges to be reported, got %v", violations)
+	}
+}
+
+func TestExternalIPAllowlist(t *testing.T) {
+	g := serviceParameters(t, `
+externalIPs:
+  allowed:
+    "*": [192.0.2.0/24]
+    ingress: [203.0.113.0/24]
+`)
+
+	service := UnmarshalService(annotatedJson)
+	service.Spec.ExternalIPs = []string{"192.0.2.10", "203.0.113.10"}
+	violations, ok := g.admitService(service).(Violations)
+	if !ok || len(violations) != 1 || violations[0].Field != "spec.externalIPs[1]" || violations[0].RuleID != "gkepublicservice.external-ips" {
+		t.Errorf("Expecting the address outside the namespace's CIDRs to be reported, got %v", violations)
+	}
+
+	service.Namespace = "ingress"
+	if err := g.admitService(service); err != nil {
+		t.Errorf("Expecting both addresses to be allowed in the ingress namespace, got %v", err)
+	}
+
+	service.Spec.ExternalIPs = []string{"not-an-ip"}
+	if err := g.admitService(service); err == nil {
+		t.Error("Expecting an invalid address to be disallowed")
+	}
+}
+
+func TestExposureParameters(t *testing.T) {
+	for _, parameters := range []string{
+		`nodePorts: {mode: sometimes}`,
+		`nodePorts: {ranges: ["30100-30000"]}`,
+		`externalIPs: {allowed: {"*": [192.0.2.0]}}`,
+	} {
+		g := &GkeServiceAdmissionController{}
+		if err := g.SetParameters(yamlDecoder(parameters)); err == nil {
+			t.Errorf("Expecting parameters %s to be refused", parameters)
+		}
+	}
+}
+
+func TestSourceRanges(t *testing.T) {
+	g := serviceParameters(t, `sourceRanges: {}`)
+
+	service := UnmarshalService(unannotatedJson)
+	service.Annotations["gke/load-balancer-type"] = "External"
+	violations, ok := g.admitService(service).(Violations)
+	if !ok || len(violations) != 1 || violations[0].RuleID != "gkepublicservice.source-ranges" {
+		t.Errorf("Expecting an external service without source ranges to be disallowed, got %v", violations)
+	}
+
+	service.Spec.LoadBalancerSourceRanges = []string{"203.0.113.0/24"}
+	if err := g.admitService(service); err != nil {
+		t.Errorf("Expecting an external service with source ranges to be allowed, got %v", err)
+	}
+
+	service.Spec.LoadBalancerSourceRanges = nil
+	service.Annotations["service.beta.kubernetes.io/load-balancer-source-ranges"] = "203.0.113.0/24, 198.51.100.0/24"
+	if err := g.admitService(service); err != nil {
+		t.Errorf("Expecting source ranges in the annotation to be allowed, got %v", err)
+	}
+
+	// internal services don't need source ranges
+	if err := g.admitService(UnmarshalService(annotatedJson)); err != nil {
+		t.Errorf("Expecting an internal service to be allowed, got %v", err)
+	}
+}
+
+func TestWorldOpenSourceRanges(t *testing.T) {
+	g := serviceParameters(t, `sourceRanges: {}`)
+
+	service := UnmarshalService(unannotatedJson)
+	service.Annotations["gke/load-balancer-type"] = "External"
+	service.Spec.LoadBalancerSourceRanges = []string{"0.0.0.0/0", "203.0.113"}
+	violations, ok := g.admitService(service).(Violations)
+	if !ok || len(violations) != 2 {
+		t.Fatalf("Expecting the invalid and world-open ranges to be reported, got %v", violations)
+	}
+	if violations[0].RuleID != "gkepublicservice.source-ranges-cidr" || violations[0].Field != "spec.loadBalancerSourceRanges[1]" {
+		t.Errorf("Unexpected violation %+v", violations[0])
+	}
+	if violations[1].RuleID != "gkepublicservice.world-open" || violations[1].Field != "metadata.annotations[gke/world-open-justification]" {
+		t.Errorf("Unexpected violation %+v", violations[1])
+	}
+
+	service.Spec.LoadBalancerSourceRanges = []string{"::/0"}
+	service.Annotations["gke/world-open-justification"] = "Public website, see TICKET-123"
+	if err := g.admitService(service); err != nil {
+		t.Errorf("Expecting a justified world-open service to be allowed, got %v", err)
+	}
+}
+
+func TestPortAllowlist(t *testing.T) {
+	g := serviceParameters(t, `ports: {allowed: ["80/TCP", "443/tcp", "8000-8099"], namespaces: {dns: ["53/UDP"]}}`)
+
+	service := UnmarshalService(unannotatedJson)
+	service.Annotations["gke/load-balancer-type"] = "External"
+	service.Spec.Ports = []corev1.ServicePort{
+		{Port: 443, Protocol: corev1.ProtocolTCP},
+		{Port: 8080, Protocol: corev1.ProtocolUDP},
+		{Port: 80},
+		{Port: 9090, Protocol: corev1.ProtocolTCP},
+		{Port: 80, Protocol: corev1.ProtocolUDP},
+	}
+	violations, ok := g.admitService(service).(Violations)
+	if !ok || len(violations) != 2 {
+		t.Fatalf("Expecting one violation per disallowed port, got %v", violations)
+	}
+	if violations[0].RuleID != "gkepublicservice.port" || violations[0].Field != "spec.ports[3]" || violations[1].Field != "spec.ports[4]" {
+		t.Errorf("Unexpected violations %v", violations)
+	}
+
+	// the namespace's ports replace the default
+	service.Namespace = "dns"
+	service.Spec.Ports = []corev1.ServicePort{{Port: 53, Protocol: corev1.ProtocolUDP}, {Port: 443, Protocol: corev1.ProtocolTCP}}
+	violations, ok = g.admitService(service).(Violations)
+	if !ok || len(violations) != 1 || violations[0].Field != "spec.ports[1]" {
+		t.Errorf("Expecting the namespace's allowlist to apply, got %v", violations)
+	}
+
+	// internal services may expose any port
+	service = UnmarshalService(annotatedJson)
+	service.Spec.Ports = []corev1.ServicePort{{Port: 9090}}
+	if err := g.admitService(service); err != nil {
+		t.Errorf("Expecting an internal service to be allowed, got %v", err)
+	}
+
+	for _, parameters := range []string{`ports: {allowed: ["443/HTTP"]}`, `ports: {namespaces: {dns: ["0"]}}`} {
+		if err := (&GkeServiceAdmissionController{}).SetParameters(yamlDecoder(parameters)); err == nil {
+			t.Errorf("Expecting parameters %s to be refused", parameters)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Each external load balancer costs money and a static IP, so the number each
+// namespace may have can be limited. The existing load balancers are counted
+// from the cluster's Services, which must be provided with SetServiceLister.
+
+type LoadBalancerQuota struct {
+	// The most external load balancers each namespace may have, with "*"
+	// applying to namespaces not listed. Namespaces without a limit are
+	// unlimited.
+	Limits map[string]int `yaml:"limits" json:"limits,omitempty"`
+}
+
+// The cluster's Services, e.g. a clusterstate.Services kept up to date by a
+// watch
+type ServiceLister interface {
+	// The Services in the namespace, and whether they've been listed yet
+	List(namespace string) ([]corev1.Service, bool)
+}
+
+// Implemented by handlers that may count the cluster's Services, so that
+// configurations needing a ServiceLister can be refused when there won't be
+// one
+type ServiceCounter interface {
+	CountsServices() bool
+}
+
+var (
+	serviceListerLock sync.RWMutex
+	serviceLister     ServiceLister
+)
+
+// Set the Services counted by the loadBalancerQuota
+func SetServiceLister(l ServiceLister) {
+	serviceListerLock.Lock()
+	defer serviceListerLock.Unlock()
+	serviceLister = l
+}
+
+func (g *GkeServiceAdmissionController) CountsServices() bool {
+	return g.LoadBalancerQuota != nil
+}
+
+func currentServiceLister() ServiceLister {
+	serviceListerLock.RLock()
+	defer serviceListerLock.RUnlock()
+	return serviceLister
+}
+
+func (q *LoadBalancerQuota) validate() error {
+	for namespace, limit := range q.Limits {
+		if limit < 0 {
+			return fmt.Errorf("limits[%s]: must not be negative", namespace)
+		}
+	}
+	return nil
+}
+
+func (q *LoadBalancerQuota) limit(namespace string) (int, bool) {
+	if limit, found := q.Limits[namespace]; found {
+		return limit, true
+	}
+	limit, found := q.Limits["*"]
+	return limit, found
+}
+
+func (g *GkeServiceAdmissionController) externalLoadBalancer(service *corev1.Service) bool {
+	return service.Spec.Type == corev1.ServiceTypeLoadBalancer && !g.internal(service)
+}
+
+// deny a new external load balancer, or a Service being made one, beyond the
+// namespace's limit. Services that already were one aren't counted again.
+func (g *GkeServiceAdmissionController) admitQuota(old, service *corev1.Service) Violations {
+	if g.LoadBalancerQuota == nil || !g.externalLoadBalancer(service) || (old != nil && g.externalLoadBalancer(old)) {
+		return nil
+	}
+	limit, found := g.LoadBalancerQuota.limit(service.Namespace)
+	if !found {
+		return nil
+	}
+
+	var services []corev1.Service
+	synced := false
+	if lister := currentServiceLister(); lister != nil {
+		services, synced = lister.List(service.Namespace)
+	}
+	if !synced {
+		return Violations{{
+			Field:   field.NewPath("spec", "type").String(),
+			RuleID:  "gkepublicservice.quota",
+			Message: fmt.Sprintf("The external load balancers in namespace '%s' can't be counted yet, so the service '%s' can't be made public.", service.Namespace, service.Name),
+		}}
+	}
+
+	count := 0
+	for i := range services {
+		if services[i].Name != service.Name && g.externalLoadBalancer(&services[i]) {
+			count++
+		}
+	}
+	if count < limit {
+		return nil
+	}
+	return Violations{{
+		Field:   field.NewPath("spec", "type").String(),
+		RuleID:  "gkepublicservice.quota",
+		Message: fmt.Sprintf("The namespace '%s' already has %d external load balancers, its limit of %d, so the service '%s' can't be made public.", service.Namespace, count, limit, service.Name),
+	}}
+}
@@ -0,0 +1,86 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/benburry/k8s-admission-webhooks/clusterstate"
+)
+
+// an external load balancer in the default namespace
+func externalService(name string) corev1.Service {
+	service := UnmarshalService(unannotatedJson)
+	service.Name = name
+	service.Annotations["gke/load-balancer-type"] = "External"
+	return *service
+}
+
+func TestLoadBalancerQuota(t *testing.T) {
+	g := serviceParameters(t, `loadBalancerQuota: {limits: {"*": 2, unlimited: 100}}`)
+
+	services := clusterstate.NewServices()
+	SetServiceLister(services)
+	defer SetServiceLister(nil)
+
+	service := externalService("test-service")
+	violations, ok := g.admitUpdate(context.Background(), nil, &service).(Violations)
+	if !ok || len(violations) != 1 || !strings.Contains(violations[0].Message, "can't be counted yet") {
+		t.Errorf("Expecting services not to be made public before the cluster's services are known, got %v", violations)
+	}
+
+	internal := UnmarshalService(annotatedJson)
+	internal.Name = "internal"
+	services.Replace([]corev1.Service{externalService("a"), *internal})
+	if err := g.admitUpdate(context.Background(), nil, &service); err != nil {
+		t.Errorf("Expecting a service within the quota to be allowed, got %v", err)
+	}
+
+	services.Update(externalService("b"))
+	violations, ok = g.admitUpdate(context.Background(), nil, &service).(Violations)
+	if !ok || len(violations) != 1 || violations[0].RuleID != "gkepublicservice.quota" || !strings.Contains(violations[0].Message, "already has 2 external load balancers, its limit of 2") {
+		t.Errorf("Expecting a service beyond the quota to be disallowed, with the count, got %v", violations)
+	}
+
+	// updates to existing external load balancers aren't counted again
+	existing := externalService("b")
+	if err := g.admitUpdate(context.Background(), &existing, &existing); err != nil {
+		t.Errorf("Expecting an existing external service to be updated, got %v", err)
+	}
+	// but making an internal one external is
+	if _, ok := g.admitUpdate(context.Background(), internal, &service).(Violations); !ok {
+		t.Error("Expecting an internal service made external beyond the quota to be disallowed")
+	}
+
+	// internal services, and namespaces with their own limits, aren't limited
+	if err := g.admitUpdate(context.Background(), nil, UnmarshalService(annotatedJson)); err != nil {
+		t.Errorf("Expecting an internal service to be allowed, got %v", err)
+	}
+	service.Namespace = "unlimited"
+	if err := g.admitUpdate(context.Background(), nil, &service); err != nil {
+		t.Errorf("Expecting a service in a namespace with a larger limit to be allowed, got %v", err)
+	}
+
+	if _, cacheable := g.CacheContent(UnmarshalAR(unannotatedJson)); cacheable {
+		t.Error("Expecting decisions depending on the quota not to be cached")
+	}
+	if err := (&GkeServiceAdmissionController{}).SetParameters(yamlDecoder(`loadBalancerQuota: {limits: {default: -1}}`)); err == nil {
+		t.Error("Expecting a negative limit to be refused")
+	}
+}
@@ -0,0 +1,208 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"github.com/benburry/k8s-admission-webhooks/approval"
+)
+
+// Rules for updates to a Service, comparing it with the existing object.
+// Updates that increase the Service's exposure are held to every rule, and
+// the escalation is reported when they're disallowed. Otherwise, only
+// violations the existing object didn't already have are reported, so that
+// Services created before a rule was configured can still be updated, and
+// brought into line in steps. Updates that only change finalizers, or of
+// Services being deleted, are always allowed, so that controllers can finish
+// deleting them.
+
+// how a Service's exposure increased in an update
+type exposureChange struct {
+	// ClusterIP to NodePort or LoadBalancer, or NodePort to LoadBalancer
+	typeEscalated bool
+	// an internal load balancer made external
+	madeExternal bool
+	// the indices of the external IPs added
+	addedExternalIPs []int
+	// the indices of the ports added to an external load balancer
+	addedPorts []int
+}
+
+// how far outside the cluster each type of Service can be reached from
+func typeExposure(t corev1.ServiceType) int {
+	switch t {
+	case corev1.ServiceTypeLoadBalancer:
+		return 2
+	case corev1.ServiceTypeNodePort:
+		return 1
+	}
+	return 0
+}
+
+func (g *GkeServiceAdmissionController) compareExposure(old, service *corev1.Service) exposureChange {
+	var change exposureChange
+	before, after := typeExposure(old.Spec.Type), typeExposure(service.Spec.Type)
+	change.typeEscalated = after > before
+
+	if old.Spec.Type == corev1.ServiceTypeLoadBalancer && service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		change.madeExternal = g.internal(old) && !g.internal(service)
+	}
+
+	for i, ip := range service.Spec.ExternalIPs {
+		if !contains(old.Spec.ExternalIPs, ip) {
+			change.addedExternalIPs = append(change.addedExternalIPs, i)
+		}
+	}
+
+	if g.externalLoadBalancer(old) && g.externalLoadBalancer(service) {
+		var existing []string
+		for _, port := range old.Spec.Ports {
+			existing = append(existing, approval.Port(port.Port, string(port.Protocol)))
+		}
+		for i, port := range service.Spec.Ports {
+			if !contains(existing, approval.Port(port.Port, string(port.Protocol))) {
+				change.addedPorts = append(change.addedPorts, i)
+			}
+		}
+	}
+	return change
+}
+
+func (c exposureChange) escalated() bool {
+	return c.typeEscalated || c.madeExternal || len(c.addedExternalIPs) > 0 || len(c.addedPorts) > 0
+}
+
+func (c exposureChange) violations(old, service *corev1.Service) Violations {
+	var violations Violations
+	if c.typeEscalated {
+		violations = append(violations, Violation{
+			Field:   field.NewPath("spec", "type").String(),
+			RuleID:  "gkepublicservice.escalation-type",
+			Message: fmt.Sprintf("The service '%s' is being changed from %s to %s, making it reachable from outside the cluster.", service.Name, serviceType(old), serviceType(service)),
+		})
+	}
+	if c.madeExternal {
+		violations = append(violations, Violation{
+			Field:   field.NewPath("metadata", "annotations").String(),
+			RuleID:  "gkepublicservice.escalation-internal",
+			Message: fmt.Sprintf("The service '%s' has an internal load balancer, and is being changed to a public one.", service.Name),
+		})
+	}
+	for _, i := range c.addedExternalIPs {
+		violations = append(violations, Violation{
+			Field:   field.NewPath("spec", "externalIPs").Index(i).String(),
+			RuleID:  "gkepublicservice.escalation-external-ips",
+			Message: fmt.Sprintf("The external IP '%s' is being added to service '%s'.", service.Spec.ExternalIPs[i], service.Name),
+		})
+	}
+	for _, i := range c.addedPorts {
+		port := service.Spec.Ports[i]
+		violations = append(violations, Violation{
+			Field:   field.NewPath("spec", "ports").Index(i).String(),
+			RuleID:  "gkepublicservice.escalation-ports",
+			Message: fmt.Sprintf("The port %s is being added to public service '%s'.", approval.Port(port.Port, string(port.Protocol)), service.Name),
+		})
+	}
+	return violations
+}
+
+func serviceType(service *corev1.Service) corev1.ServiceType {
+	if service.Spec.Type == "" {
+		return corev1.ServiceTypeClusterIP
+	}
+	return service.Spec.Type
+}
+
+// admit the Service, given the existing object on UPDATE, or nil
+func (g *GkeServiceAdmissionController) admitUpdate(ctx context.Context, old, service *corev1.Service) error {
+	violations := asViolations(g.admitService(service))
+	violations = append(violations, g.admitQuota(old, service)...)
+	if old == nil || len(violations) == 0 {
+		return orNil(violations)
+	}
+
+	if service.DeletionTimestamp != nil || onlyFinalizersChanged(old, service) {
+		level.Info(LoggerFrom(ctx)).Log("msg", "Allowing an update of a service being deleted, or of its finalizers", "rejection", violations.Error())
+		return nil
+	}
+
+	// escalations are held to every rule
+	if change := g.compareExposure(old, service); change.escalated() {
+		return append(change.violations(old, service), violations...)
+	}
+
+	// otherwise, the violations the existing object already had aren't the
+	// update's. Approvals are only needed to increase exposure, so that
+	// approved services can still be updated once they've expired.
+	existing := map[string]bool{}
+	for _, v := range asViolations(g.admitService(old)) {
+		existing[v.RuleID+"\x00"+v.Field] = true
+	}
+	var introduced Violations
+	for _, v := range violations {
+		if v.RuleID != "gkepublicservice.approval" && !existing[v.RuleID+"\x00"+v.Field] {
+			introduced = append(introduced, v)
+		}
+	}
+	if len(introduced) < len(violations) {
+		level.Debug(LoggerFrom(ctx)).Log("msg", "Ignoring violations the existing service already had", "ignored", len(violations)-len(introduced))
+	}
+	return orNil(introduced)
+}
+
+func asViolations(err error) Violations {
+	violations, _ := err.(Violations)
+	return violations
+}
+
+func orNil(violations Violations) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	return violations
+}
+
+// whether the update changes nothing but the Service's finalizers (and
+// status)
+func onlyFinalizersChanged(old, service *corev1.Service) bool {
+	before, after := *old, *service
+	before.Finalizers, after.Finalizers = nil, nil
+	before.ResourceVersion, after.ResourceVersion = "", ""
+	before.Status, after.Status = corev1.ServiceStatus{}, corev1.ServiceStatus{}
+	return reflect.DeepEqual(before, after)
+}
+
+// fetch the existing Service object out of the AdmissionReview, or nil if
+// the request isn't an UPDATE
+func extractOldService(ar *v1beta1.AdmissionReview) (*corev1.Service, error) {
+	if ar.Request.Operation != v1beta1.Update || len(ar.Request.OldObject.Raw) == 0 {
+		return nil, nil
+	}
+
+	service := corev1.Service{}
+	if err := json.Unmarshal(ar.Request.OldObject.Raw, &service); err != nil {
+		return nil, err
+	}
+	return &service, nil
+}
@@ -0,0 +1,169 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// an UPDATE review of the service, from the old one
+func updateReview(t *testing.T, old, service *corev1.Service) *v1beta1.AdmissionReview {
+	ar := UnmarshalAR(unannotatedJson)
+	ar.Request.Operation = v1beta1.Update
+	var err error
+	if ar.Request.Object.Raw, err = json.Marshal(service); err != nil {
+		t.Fatal(err)
+	}
+	if ar.Request.OldObject.Raw, err = json.Marshal(old); err != nil {
+		t.Fatal(err)
+	}
+	return ar
+}
+
+func reviewRuleIDs(g *GkeServiceAdmissionController, ar *v1beta1.AdmissionReview) []string {
+	var ids []string
+	for _, v := range g.Review(context.Background(), ar).Violations {
+		ids = append(ids, v.RuleID)
+	}
+	return ids
+}
+
+func TestUpdateEscalations(t *testing.T) {
+	g := serviceParameters(t, `externalIPs: {}`)
+
+	// ClusterIP to LoadBalancer
+	old := UnmarshalService(unannotatedJson)
+	old.Spec.Type = corev1.ServiceTypeClusterIP
+	service := UnmarshalService(unannotatedJson)
+	ids := reviewRuleIDs(g, updateReview(t, old, service))
+	if len(ids) != 2 || ids[0] != "gkepublicservice.escalation-type" || ids[1] != "gkepublicservice.opt-in" {
+		t.Errorf("Expecting the type escalation to be reported, got %v", ids)
+	}
+
+	// internal to external
+	old = UnmarshalService(annotatedJson)
+	ids = reviewRuleIDs(g, updateReview(t, old, service))
+	if len(ids) != 2 || ids[0] != "gkepublicservice.escalation-internal" {
+		t.Errorf("Expecting removing the internal annotation to be reported, got %v", ids)
+	}
+
+	// added external IPs
+	old = UnmarshalService(annotatedJson)
+	service = UnmarshalService(annotatedJson)
+	service.Spec.ExternalIPs = []string{"203.0.113.10"}
+	ids = reviewRuleIDs(g, updateReview(t, old, service))
+	if len(ids) != 2 || ids[0] != "gkepublicservice.escalation-external-ips" || ids[1] != "gkepublicservice.external-ips" {
+		t.Errorf("Expecting the added external IP to be reported, got %v", ids)
+	}
+
+	// escalations the policy allows are allowed
+	old = UnmarshalService(annotatedJson)
+	service = UnmarshalService(unannotatedJson)
+	service.Annotations["gke/load-balancer-type"] = "External"
+	if ids := reviewRuleIDs(g, updateReview(t, old, service)); len(ids) != 0 {
+		t.Errorf("Expecting an opted-in service to be allowed, got %v", ids)
+	}
+}
+
+func TestUpdateExistingViolations(t *testing.T) {
+	g := serviceParameters(t, `{externalIPs: {}, sourceRanges: {}, ports: {allowed: ["1024/TCP", "443/TCP"]}}`)
+
+	// an external service created before source ranges were required, with
+	// external IPs
+	old := UnmarshalService(unannotatedJson)
+	old.Annotations["gke/load-balancer-type"] = "External"
+	old.Spec.ExternalIPs = []string{"203.0.113.10", "203.0.113.11"}
+
+	// updates not adding violations are allowed
+	service := old.DeepCopy()
+	service.Labels = map[string]string{"team": "web"}
+	if ids := reviewRuleIDs(g, updateReview(t, old, service)); len(ids) != 0 {
+		t.Errorf("Expecting an update keeping the existing violations to be allowed, got %v", ids)
+	}
+	service.Spec.ExternalIPs = []string{"203.0.113.10"}
+	if ids := reviewRuleIDs(g, updateReview(t, old, service)); len(ids) != 0 {
+		t.Errorf("Expecting removing an external IP to be allowed, got %v", ids)
+	}
+	service.Spec.Type = corev1.ServiceTypeClusterIP
+	if ids := reviewRuleIDs(g, updateReview(t, old, service)); len(ids) != 0 {
+		t.Errorf("Expecting changing to ClusterIP to be allowed, got %v", ids)
+	}
+
+	// but new violations are reported, even alongside a reduction
+	service = old.DeepCopy()
+	service.Spec.ExternalIPs = []string{"203.0.113.10"}
+	service.Spec.LoadBalancerSourceRanges = []string{"0.0.0.0/0"}
+	if ids := reviewRuleIDs(g, updateReview(t, old, service)); len(ids) != 1 || ids[0] != "gkepublicservice.world-open" {
+		t.Errorf("Expecting only the new violation to be reported, got %v", ids)
+	}
+
+	// and adding a port to a public service is an escalation
+	service = old.DeepCopy()
+	service.Spec.ExternalIPs = []string{"203.0.113.10"}
+	service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Port: 22, Protocol: corev1.ProtocolTCP})
+	if ids := reviewRuleIDs(g, updateReview(t, old, service)); len(ids) != 4 || ids[0] != "gkepublicservice.escalation-ports" || ids[3] != "gkepublicservice.port" {
+		t.Errorf("Expecting the new port to be reported with every violation, got %v", ids)
+	}
+
+	// and escalations are held to every rule
+	service = old.DeepCopy()
+	service.Spec.ExternalIPs = []string{"203.0.113.10", "198.51.100.1"}
+	ids := reviewRuleIDs(g, updateReview(t, old, service))
+	if len(ids) != 4 || ids[0] != "gkepublicservice.escalation-external-ips" {
+		t.Errorf("Expecting the added external IP to be reported with every violation, got %v", ids)
+	}
+}
+
+func TestUpdateDeletion(t *testing.T) {
+	g := serviceParameters(t, `sourceRanges: {}`)
+
+	// an external service created before source ranges were required
+	old := UnmarshalService(unannotatedJson)
+	old.Annotations["gke/load-balancer-type"] = "External"
+	old.Finalizers = []string{"service.kubernetes.io/load-balancer-cleanup"}
+
+	// the service controller removes its finalizer when the service is deleted
+	service := old.DeepCopy()
+	service.Finalizers = nil
+	if ids := reviewRuleIDs(g, updateReview(t, old, service)); len(ids) != 0 {
+		t.Errorf("Expecting removing the finalizer to be allowed, got %v", ids)
+	}
+
+	// the service is no longer opted in, which would otherwise be reported
+	service = old.DeepCopy()
+	delete(service.Annotations, "gke/load-balancer-type")
+	if ids := reviewRuleIDs(g, updateReview(t, old, service)); len(ids) != 1 || ids[0] != "gkepublicservice.opt-in" {
+		t.Errorf("Expecting other updates to be reviewed, got %v", ids)
+	}
+	now := metav1.Now()
+	service.DeletionTimestamp = &now
+	if ids := reviewRuleIDs(g, updateReview(t, old, service)); len(ids) != 0 {
+		t.Errorf("Expecting an update of a service being deleted to be allowed, got %v", ids)
+	}
+}
+
+func TestCreateIgnoresOldObject(t *testing.T) {
+	ar := updateReview(t, UnmarshalService(annotatedJson), UnmarshalService(unannotatedJson))
+	ar.Request.Operation = v1beta1.Create
+	if ids := reviewRuleIDs(defaultServicePolicy, ar); len(ids) != 1 || ids[0] != "gkepublicservice.opt-in" {
+		t.Errorf("Expecting only the new object to be reviewed on CREATE, got %v", ids)
+	}
+}
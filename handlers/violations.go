@@ -0,0 +1,62 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package handlers
+
+import (
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A single reason for rejecting an object. Handlers that can find several
+// problems with an object should return all of them from Admit as Violations,
+// so that the user can fix them all at once rather than one per attempt.
+type Violation struct {
+	// The path to the offending field, as formatted by
+	// k8s.io/apimachinery/pkg/util/validation/field, e.g. data[test.rules]
+	Field string `json:"field,omitempty"`
+	// A stable identifier for the rule that was broken, e.g.
+	// prometheuslinter.syntax
+	RuleID  string `json:"ruleID,omitempty"`
+	Message string `json:"message"`
+
+	// set once the message has been replaced by a MessageTemplate, so that
+	// nested handlers don't render it twice
+	rendered bool
+}
+
+type Violations []Violation
+
+func (v Violations) Error() string {
+	messages := make([]string, len(v))
+	for i, violation := range v {
+		messages[i] = violation.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// convert the violations into the causes returned in the Status of a denied
+// AdmissionResponse
+func (v Violations) causes() []metav1.StatusCause {
+	causes := make([]metav1.StatusCause, len(v))
+	for i, violation := range v {
+		causes[i] = metav1.StatusCause{
+			Type:    metav1.CauseType(violation.RuleID),
+			Message: violation.Message,
+			Field:   violation.Field,
+		}
+	}
+	return causes
+}
@@ -15,24 +15,317 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/golang/glog"
 
+	"github.com/benburry/k8s-admission-webhooks/approval"
+	"github.com/benburry/k8s-admission-webhooks/audit"
+	"github.com/benburry/k8s-admission-webhooks/clusterstate"
+	"github.com/benburry/k8s-admission-webhooks/config"
+	"github.com/benburry/k8s-admission-webhooks/export"
 	"github.com/benburry/k8s-admission-webhooks/handlers"
+	"github.com/benburry/k8s-admission-webhooks/notify"
 )
 
+// comma-separated list of handler names
+type handlerNames []string
+
+func (n *handlerNames) String() string {
+	return strings.Join(*n, ",")
+}
+
+func (n *handlerNames) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*n = append(*n, name)
+		}
+	}
+	return nil
+}
+
+// the flags selecting which handlers are enabled, shared by the server and
+// the subcommands
+type handlerFlags struct {
+	configFile    string
+	enable        handlerNames
+	disable       handlerNames
+	watchServices bool
+}
+
+func (f *handlerFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.configFile, "config", "", "Configuration file. If not given, every built-in handler is enabled with its defaults.")
+	flags.Var(&f.enable, "enable-handlers", "Comma-separated handlers to enable, replacing those in the configuration file. Handlers not in the file are enabled with their defaults.")
+	flags.Var(&f.disable, "disable-handlers", "Comma-separated handlers to disable.")
+	flags.BoolVar(&f.watchServices, "watch-services", false, "Watch the cluster's Services, as the gkepublicservice handler's loadBalancerQuota needs. Uses the pod's service account.")
+}
+
+func (f *handlerFlags) adjust(cfg *config.Config) error {
+	if err := cfg.SelectHandlers(f.enable, f.disable); err != nil {
+		return err
+	}
+	// without the Services, every new external load balancer would be denied
+	if counters := cfg.ServiceCounters(); len(counters) > 0 && !f.watchServices {
+		return fmt.Errorf("%s: counting the cluster's services needs -watch-services", strings.Join(counters, ", "))
+	}
+	return nil
+}
+
+// the configuration selected by the flags, validated but not applied
+func (f *handlerFlags) load() (*config.Config, error) {
+	cfg := config.Default()
+	if f.configFile != "" {
+		var err error
+		if cfg, err = config.Load(f.configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.adjust(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
 func main() {
-	var tlsCertFile, tlsKeyFile, addr string
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check-config":
+			os.Exit(checkConfig(os.Args[2:]))
+		case "list-handlers":
+			os.Exit(listHandlers(os.Args[2:]))
+		case "mint-approval":
+			os.Exit(mintApproval(os.Args[2:]))
+		}
+	}
+
+	var tlsCertFile, tlsKeyFile, addr, adminTokenFile, logFormat, logLevel string
+	var reloadInterval time.Duration
+	var selection handlerFlags
 
 	flag.StringVar(&tlsCertFile, "tls-cert", "/etc/tls/server.pem", "TLS certificate file.")
 	flag.StringVar(&tlsKeyFile, "tls-key", "/etc/tls/server-key.pem", "TLS key file.")
 	flag.StringVar(&addr, "addr", ":8080", "TCP address to listen on")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "", "File of bearer tokens, one per line, accepted by the admin endpoints such as /policies.")
+	flag.DurationVar(&reloadInterval, "config-reload-interval", 10*time.Second, "How often to check the configuration file for changes. 0 disables reloading.")
+	flag.StringVar(&logFormat, "log-format", handlers.LogFormatGlog, "Format of request logs: glog, logfmt or json. The logfmt and json formats are written to stderr.")
+	flag.StringVar(&logLevel, "log-level", "info", "The least severe request logs written in the logfmt and json formats: debug, info, warn or error.")
+	selection.register(flag.CommandLine)
 	flag.Parse()
 
-	handlers.RegisterHandler("/prometheuslinter", &handlers.PrometheusRulesAdmissionController{})
-	handlers.RegisterHandler("/gkepublicservice", &handlers.GkeServiceAdmissionController{})
+	logger, err := handlers.NewLogger(logFormat, logLevel, os.Stderr)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	handlers.SetLogger(logger)
+
+	var cfg *config.Config
+	if selection.configFile != "" {
+		watcher := config.NewWatcher(selection.configFile, reloadInterval)
+		watcher.Adjust = selection.adjust
+
+		var err error
+		if cfg, err = watcher.Load(); err != nil {
+			glog.Fatalf("Invalid configuration file %s:\n%v", selection.configFile, err)
+		}
+		if reloadInterval > 0 {
+			go watcher.Run(make(chan struct{}))
+		}
+	} else {
+		var err error
+		if cfg, err = selection.load(); err != nil {
+			glog.Fatal(err)
+		}
+		if err := cfg.Apply(); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	// settings given on the command line take precedence over the
+	// configuration file
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if cfg.Server.Addr != "" && !explicit["addr"] {
+		addr = cfg.Server.Addr
+	}
+	if cfg.Server.TLSCertFile != "" && !explicit["tls-cert"] {
+		tlsCertFile = cfg.Server.TLSCertFile
+	}
+	if cfg.Server.TLSKeyFile != "" && !explicit["tls-key"] {
+		tlsKeyFile = cfg.Server.TLSKeyFile
+	}
+	if cfg.Server.AdminTokenFile != "" && !explicit["admin-token-file"] {
+		adminTokenFile = cfg.Server.AdminTokenFile
+	}
+
+	if adminTokenFile != "" {
+		tokens, err := handlers.LoadAdminTokens(adminTokenFile)
+		if err != nil {
+			glog.Fatalf("Unable to read admin tokens: %v", err)
+		}
+		handlers.SetAdminTokens(tokens)
+	}
+
+	if cfg.Server.RecentDecisions != nil {
+		handlers.SetRecentDecisionsSize(*cfg.Server.RecentDecisions)
+	}
+
+	if cfg.Audit != nil {
+		logger, err := audit.NewLogger(*cfg.Audit)
+		if err != nil {
+			glog.Fatalf("Unable to open audit log: %v", err)
+		}
+		handlers.RegisterDecisionSink(logger)
+	}
+
+	if cfg.Export != nil {
+		exporter, err := export.NewExporter(*cfg.Export)
+		if err != nil {
+			glog.Fatalf("Unable to export decisions: %v", err)
+		}
+		handlers.RegisterDecisionSink(exporter)
+	}
+
+	if cfg.Notifications != nil {
+		notifier, err := notify.NewNotifier(*cfg.Notifications)
+		if err != nil {
+			glog.Fatalf("Unable to send notifications: %v", err)
+		}
+		handlers.RegisterDecisionSink(notifier)
+	}
+
+	if selection.watchServices {
+		watcher, err := clusterstate.InClusterWatcher()
+		if err != nil {
+			glog.Fatalf("Unable to watch services: %v", err)
+		}
+		services := clusterstate.NewServices()
+		handlers.SetServiceLister(services)
+		go watcher.Run(services, make(chan struct{}))
+	}
 
 	s := handlers.GetServer(addr)
 	glog.Fatal(s.ListenAndServeTLS(tlsCertFile, tlsKeyFile))
 }
+
+// validate a configuration file without starting the server
+func checkConfig(args []string) int {
+	var selection handlerFlags
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	selection.register(flags)
+	flags.Parse(args)
+
+	if selection.configFile == "" {
+		fmt.Fprintln(os.Stderr, "check-config: -config is required")
+		return 2
+	}
+
+	if _, err := selection.load(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n%v\n", selection.configFile, err)
+		return 1
+	}
+
+	fmt.Printf("%s is valid\n", selection.configFile)
+	return 0
+}
+
+// print every available handler, and whether the flags enable it
+func listHandlers(args []string) int {
+	var selection handlerFlags
+	flags := flag.NewFlagSet("list-handlers", flag.ExitOnError)
+	selection.register(flags)
+	flags.Parse(args)
+
+	cfg, err := selection.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	enabled := map[string]bool{}
+	for _, h := range cfg.Handlers {
+		enabled[h.Name] = true
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tENABLED\tDEFAULT PATH\tDESCRIPTION")
+	for _, factory := range handlers.GetHandlerFactories() {
+		fmt.Fprintf(w, "%s\t%v\t%s\t%s\n", factory.Name, enabled[factory.Name], factory.DefaultPath, factory.Description)
+	}
+	w.Flush()
+	return 0
+}
+
+// print a signed approval for a public service, or generate an Ed25519 key to
+// sign them with
+func mintApproval(args []string) int {
+	var keyID, hmacSecretFile, privateKeyFile, namespace, name, ports string
+	var ttl time.Duration
+	var generate bool
+	flags := flag.NewFlagSet("mint-approval", flag.ExitOnError)
+	flags.StringVar(&keyID, "key-id", "", "The id of the signing key, as configured in the gkepublicservice handler's approvals.")
+	flags.StringVar(&hmacSecretFile, "hmac-secret-file", "", "File containing the shared HMAC secret to sign with.")
+	flags.StringVar(&privateKeyFile, "ed25519-private-key-file", "", "File containing the base64 encoded Ed25519 private key to sign with.")
+	flags.StringVar(&namespace, "namespace", "", "Namespace of the approved service.")
+	flags.StringVar(&name, "name", "", "Name of the approved service.")
+	flags.StringVar(&ports, "ports", "", "Comma-separated ports the service may expose, e.g. 443/TCP,80. The protocol defaults to TCP.")
+	flags.DurationVar(&ttl, "ttl", 7*24*time.Hour, "How long the approval is valid for.")
+	flags.BoolVar(&generate, "generate-ed25519-key", false, "Write a new Ed25519 private key to -ed25519-private-key-file, and print its public key, instead of an approval.")
+	flags.Parse(args)
+
+	if generate {
+		if privateKeyFile == "" {
+			fmt.Fprintln(os.Stderr, "mint-approval: -ed25519-private-key-file is required")
+			return 2
+		}
+		public, private, err := ed25519.GenerateKey(nil)
+		if err == nil {
+			err = ioutil.WriteFile(privateKeyFile, []byte(base64.StdEncoding.EncodeToString(private.Seed())+"\n"), 0600)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(public))
+		return 0
+	}
+
+	if keyID == "" || namespace == "" || name == "" || ports == "" {
+		fmt.Fprintln(os.Stderr, "mint-approval: -key-id, -namespace, -name and -ports are required")
+		return 2
+	}
+	claims := approval.Claims{Namespace: namespace, Name: name, Expires: time.Now().Add(ttl).Unix()}
+	for _, p := range strings.Split(ports, ",") {
+		parts := strings.SplitN(strings.TrimSpace(p), "/", 2)
+		port, err := strconv.Atoi(parts[0])
+		if err != nil || port < 1 || port > 65535 {
+			fmt.Fprintf(os.Stderr, "mint-approval: invalid port '%s'\n", p)
+			return 2
+		}
+		protocol := ""
+		if len(parts) == 2 {
+			protocol = parts[1]
+		}
+		claims.Ports = append(claims.Ports, approval.Port(int32(port), protocol))
+	}
+
+	key, err := approval.LoadSigningKey(keyID, hmacSecretFile, privateKeyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mint-approval: %v\n", err)
+		return 1
+	}
+	token, err := key.Sign(claims)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mint-approval: %v\n", err)
+		return 1
+	}
+	fmt.Println(token)
+	return 0
+}
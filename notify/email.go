@@ -0,0 +1,104 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Send email through an SMTP server. STARTTLS is used when the server
+// supports it, and required to authenticate.
+
+type EmailOptions struct {
+	// The SMTP server, as host:port
+	SmartHost string   `yaml:"smarthost"`
+	From      string   `yaml:"from"`
+	To        []string `yaml:"to"`
+	// Credentials for PLAIN authentication, if the server requires it. The
+	// password is read from a file, to keep it out of the configuration.
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"passwordFile"`
+}
+
+func (o *EmailOptions) validate() error {
+	if _, _, err := net.SplitHostPort(o.SmartHost); err != nil {
+		return fmt.Errorf("smarthost must be host:port: %v", err)
+	}
+	if _, err := mail.ParseAddress(o.From); err != nil {
+		return fmt.Errorf("invalid from address '%s': %v", o.From, err)
+	}
+	if len(o.To) == 0 {
+		return fmt.Errorf("at least one to address is required")
+	}
+	for _, to := range o.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid to address '%s': %v", to, err)
+		}
+	}
+	if (o.Username == "") != (o.PasswordFile == "") {
+		return fmt.Errorf("username and passwordFile must be given together")
+	}
+	return nil
+}
+
+// overridden in tests
+var sendMail = smtp.SendMail
+
+type emailSender struct {
+	options EmailOptions
+	auth    smtp.Auth
+}
+
+func newEmailSender(options EmailOptions) (*emailSender, error) {
+	s := &emailSender{options: options}
+	if options.Username != "" {
+		password, err := ioutil.ReadFile(options.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(options.SmartHost)
+		s.auth = smtp.PlainAuth("", options.Username, strings.TrimSpace(string(password)), host)
+	}
+	return s, nil
+}
+
+func (s *emailSender) send(subject, text string) error {
+	from, _ := mail.ParseAddress(s.options.From)
+	to := make([]string, len(s.options.To))
+	for i, addr := range s.options.To {
+		parsed, _ := mail.ParseAddress(addr)
+		to[i] = parsed.Address
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.options.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(text, "\n", "\r\n", -1))
+	msg.WriteString("\r\n")
+
+	return sendMail(s.options.SmartHost, s.auth, from.Address, to, msg.Bytes())
+}
@@ -0,0 +1,392 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/benburry/k8s-admission-webhooks/handlers"
+)
+
+// Tell people when their objects are rejected, rather than leaving them to
+// find out from a failed deploy.
+//
+// Each decision that wasn't allowed is matched against the routes in turn,
+// and sent to the receivers of every matching route. Repeats of the same
+// rejection, e.g. a pipeline retrying a deploy, are only sent once per
+// dedupWindow, and each receiver is sent at most rateLimit.messages per
+// rateLimit.interval. Messages are sent asynchronously, and dropped if a
+// receiver falls too far behind.
+
+var notifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "admission_webhook",
+	Name:      "notifications_total",
+	Help:      "Notifications of rejected objects, by receiver and result.",
+}, []string{"receiver", "result"})
+
+func init() {
+	prometheus.MustRegister(notifications)
+}
+
+// The outcomes that can be notified about
+var severities = []handlers.DecisionOutcome{handlers.OutcomeDenied, handlers.OutcomeWarned, handlers.OutcomeDryRun}
+
+const queueSize = 100
+
+type Options struct {
+	Receivers []ReceiverOptions `yaml:"receivers"`
+	Routes    []Route           `yaml:"routes"`
+	// How long a repeated rejection isn't notified again. Defaults to 1h.
+	DedupWindow time.Duration `yaml:"dedupWindow"`
+	RateLimit   RateLimit     `yaml:"rateLimit"`
+}
+
+type RateLimit struct {
+	// The most messages sent to each receiver per interval. Defaults to 10
+	// per minute.
+	Messages int           `yaml:"messages"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+type ReceiverOptions struct {
+	Name  string        `yaml:"name"`
+	Slack *SlackOptions `yaml:"slack"`
+	Email *EmailOptions `yaml:"email"`
+}
+
+// Decisions are sent to the route's receivers when they match every one of
+// its lists. An empty list matches anything.
+type Route struct {
+	Receivers  []string `yaml:"receivers"`
+	Namespaces []string `yaml:"namespaces"`
+	Handlers   []string `yaml:"handlers"`
+	// Defaults to denied
+	Severities []handlers.DecisionOutcome `yaml:"severities"`
+	// Stop matching further routes if this one matches
+	Final bool `yaml:"final"`
+}
+
+func (o *Options) Validate() error {
+	var errs []string
+
+	receivers := map[string]bool{}
+	for i, r := range o.Receivers {
+		if r.Name == "" {
+			errs = append(errs, fmt.Sprintf("receivers[%d]: name is required", i))
+			continue
+		}
+		if receivers[r.Name] {
+			errs = append(errs, fmt.Sprintf("receivers[%s]: receiver is configured more than once", r.Name))
+		}
+		receivers[r.Name] = true
+
+		var err error
+		switch {
+		case r.Slack != nil && r.Email != nil:
+			err = fmt.Errorf("only one of slack or email may be given")
+		case r.Slack != nil:
+			err = r.Slack.validate()
+		case r.Email != nil:
+			err = r.Email.validate()
+		default:
+			err = fmt.Errorf("one of slack or email is required")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("receivers[%s]: %v", r.Name, err))
+		}
+	}
+
+	for i, route := range o.Routes {
+		if len(route.Receivers) == 0 {
+			errs = append(errs, fmt.Sprintf("routes[%d]: receivers are required", i))
+		}
+		for _, name := range route.Receivers {
+			if !receivers[name] {
+				errs = append(errs, fmt.Sprintf("routes[%d]: unknown receiver '%s'", i, name))
+			}
+		}
+		for _, ns := range route.Namespaces {
+			if msgs := validation.IsDNS1123Label(ns); len(msgs) > 0 {
+				errs = append(errs, fmt.Sprintf("routes[%d]: namespace '%s' is invalid: %s", i, ns, strings.Join(msgs, ", ")))
+			}
+		}
+		for _, s := range route.Severities {
+			if !validSeverity(s) {
+				errs = append(errs, fmt.Sprintf("routes[%d]: severity must be one of '%s', '%s' or '%s', not '%s'", i, handlers.OutcomeDenied, handlers.OutcomeWarned, handlers.OutcomeDryRun, s))
+			}
+		}
+	}
+
+	if o.DedupWindow < 0 || o.RateLimit.Interval < 0 || o.RateLimit.Messages < 0 {
+		errs = append(errs, "dedupWindow and rateLimit must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func validSeverity(s handlers.DecisionOutcome) bool {
+	for _, valid := range severities {
+		if s == valid {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Route) matches(d *handlers.Decision) bool {
+	outcomes := r.Severities
+	if len(outcomes) == 0 {
+		outcomes = []handlers.DecisionOutcome{handlers.OutcomeDenied}
+	}
+	return matchAny(r.Namespaces, d.Namespace) && matchAny(r.Handlers, d.Handler) && matchOutcome(outcomes, d.Outcome)
+}
+
+func matchAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOutcome(outcomes []handlers.DecisionOutcome, outcome handlers.DecisionOutcome) bool {
+	for _, o := range outcomes {
+		if o == outcome {
+			return true
+		}
+	}
+	return false
+}
+
+// Somewhere notifications are sent
+type sender interface {
+	send(subject, text string) error
+}
+
+type receiver struct {
+	name   string
+	sender sender
+	queue  chan *handlers.Decision
+
+	// a fixed window rate limit
+	windowStart time.Time
+	sent        int
+}
+
+type Notifier struct {
+	options   Options
+	receivers map[string]*receiver
+
+	lock   sync.Mutex
+	closed bool
+	// when each rejection was last notified, by receiver and rejection
+	notified  map[string]time.Time
+	lastPrune time.Time
+	// overridden in tests
+	now func() time.Time
+
+	wg sync.WaitGroup
+}
+
+// Create a notifier, and start sending notifications of decisions recorded
+// with it
+func NewNotifier(options Options) (*Notifier, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if options.DedupWindow == 0 {
+		options.DedupWindow = time.Hour
+	}
+	if options.RateLimit.Messages == 0 {
+		options.RateLimit.Messages = 10
+	}
+	if options.RateLimit.Interval == 0 {
+		options.RateLimit.Interval = time.Minute
+	}
+
+	n := &Notifier{
+		options:   options,
+		receivers: map[string]*receiver{},
+		notified:  map[string]time.Time{},
+		now:       time.Now,
+	}
+	for _, r := range options.Receivers {
+		var s sender
+		var err error
+		if r.Slack != nil {
+			s = newSlackSender(*r.Slack)
+		} else {
+			s, err = newEmailSender(*r.Email)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("receivers[%s]: %v", r.Name, err)
+		}
+		n.receivers[r.Name] = &receiver{name: r.Name, sender: s, queue: make(chan *handlers.Decision, queueSize)}
+	}
+
+	for _, r := range n.receivers {
+		n.wg.Add(1)
+		go n.run(r)
+	}
+	return n, nil
+}
+
+func (n *Notifier) Record(decision *handlers.Decision) {
+	if !validSeverity(decision.Outcome) {
+		return
+	}
+
+	for _, route := range n.options.Routes {
+		if !route.matches(decision) {
+			continue
+		}
+		for _, name := range route.Receivers {
+			n.notify(n.receivers[name], decision)
+		}
+		if route.Final {
+			return
+		}
+	}
+}
+
+// Send any queued notifications, then stop. Decisions recorded after Close
+// are not notified.
+func (n *Notifier) Close() {
+	n.lock.Lock()
+	if !n.closed {
+		n.closed = true
+		for _, r := range n.receivers {
+			close(r.queue)
+		}
+	}
+	n.lock.Unlock()
+	n.wg.Wait()
+}
+
+func (n *Notifier) notify(r *receiver, decision *handlers.Decision) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return
+	}
+
+	now := n.now()
+	key, ok := n.allow(r, decision, now)
+	if !ok {
+		return
+	}
+
+	select {
+	case r.queue <- decision:
+		// only count notifications actually queued, so that a dropped one
+		// doesn't suppress its repeats
+		r.sent++
+		n.notified[key] = now
+	default:
+		notifications.WithLabelValues(r.name, "dropped").Inc()
+		glog.Warningf("Notification queue for %s is full, dropping notification of %s", r.name, decision.UID)
+	}
+}
+
+// allow reports whether a decision should be sent to the receiver, after
+// removing repeats and applying the rate limit, and its dedup key. Called
+// with the lock held.
+func (n *Notifier) allow(r *receiver, decision *handlers.Decision, now time.Time) (string, bool) {
+	if now.Sub(n.lastPrune) > n.options.DedupWindow {
+		for key, at := range n.notified {
+			if now.Sub(at) >= n.options.DedupWindow {
+				delete(n.notified, key)
+			}
+		}
+		n.lastPrune = now
+	}
+
+	// the UID differs on each retry, so isn't part of the key
+	key := strings.Join([]string{r.name, decision.Handler, string(decision.Outcome), string(decision.Operation),
+		decision.Kind, decision.Namespace, decision.Name, decision.Message}, "\x00")
+	if at, ok := n.notified[key]; ok && now.Sub(at) < n.options.DedupWindow {
+		notifications.WithLabelValues(r.name, "deduplicated").Inc()
+		return "", false
+	}
+
+	if now.Sub(r.windowStart) >= n.options.RateLimit.Interval {
+		r.windowStart = now
+		r.sent = 0
+	}
+	if r.sent >= n.options.RateLimit.Messages {
+		notifications.WithLabelValues(r.name, "rate_limited").Inc()
+		return "", false
+	}
+	return key, true
+}
+
+func (n *Notifier) run(r *receiver) {
+	defer n.wg.Done()
+
+	for decision := range r.queue {
+		subject, text := message(decision)
+		if err := r.sender.send(subject, text); err != nil {
+			notifications.WithLabelValues(r.name, "failed").Inc()
+			glog.Errorf("Unable to notify %s of %s: %v", r.name, decision.UID, err)
+			continue
+		}
+		notifications.WithLabelValues(r.name, "sent").Inc()
+	}
+}
+
+// message describes the decision, as a subject line and body
+func message(d *handlers.Decision) (string, string) {
+	object := d.Name
+	if d.Namespace != "" {
+		object = d.Namespace + "/" + d.Name
+	}
+
+	var verb string
+	switch d.Outcome {
+	case handlers.OutcomeDenied:
+		verb = "Denied"
+	case handlers.OutcomeWarned:
+		verb = "Warned about"
+	default:
+		verb = "Would have denied"
+	}
+	subject := fmt.Sprintf("%s %s of %s %s", verb, d.Operation, d.Kind, object)
+
+	lines := []string{
+		fmt.Sprintf("%s %s of %s %s by %s, requested by %s.", verb, d.Operation, d.Kind, object, d.Handler, d.User),
+		"",
+	}
+	if len(d.Violations) == 0 {
+		lines = append(lines, d.Message)
+	}
+	for _, v := range d.Violations {
+		lines = append(lines, fmt.Sprintf("- %s: %s (%s)", v.Field, v.Message, v.RuleID))
+	}
+	return subject, strings.Join(lines, "\n")
+}
@@ -0,0 +1,254 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benburry/k8s-admission-webhooks/handlers"
+)
+
+type slackReceiver struct {
+	sync.Mutex
+	messages []slackMessage
+}
+
+func (r *slackReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var msg slackMessage
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.messages = append(r.messages, msg)
+}
+
+func testDecision(namespace string, outcome handlers.DecisionOutcome) *handlers.Decision {
+	return &handlers.Decision{
+		UID:       "d7e11614-4512-11e8-8d4f-b827ebf9752a",
+		Handler:   "gkepublicservice",
+		Kind:      "Service",
+		Namespace: namespace,
+		Name:      "test-service",
+		Operation: "CREATE",
+		User:      "deployer",
+		Outcome:   outcome,
+		Message:   "The service 'test-service' is public",
+	}
+}
+
+func TestRouting(t *testing.T) {
+	platform, payments := &slackReceiver{}, &slackReceiver{}
+	platformServer, paymentsServer := httptest.NewServer(platform), httptest.NewServer(payments)
+	defer platformServer.Close()
+	defer paymentsServer.Close()
+
+	n, err := NewNotifier(Options{
+		Receivers: []ReceiverOptions{
+			{Name: "platform", Slack: &SlackOptions{URL: platformServer.URL}},
+			{Name: "payments", Slack: &SlackOptions{URL: paymentsServer.URL, Channel: "#payments"}},
+		},
+		Routes: []Route{
+			{Receivers: []string{"payments"}, Namespaces: []string{"payments"}, Severities: []handlers.DecisionOutcome{handlers.OutcomeDenied, handlers.OutcomeWarned}, Final: true},
+			{Receivers: []string{"platform"}, Handlers: []string{"gkepublicservice"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.Record(testDecision("payments", handlers.OutcomeWarned))
+	n.Record(testDecision("payments", handlers.OutcomeDryRun))
+	n.Record(testDecision("default", handlers.OutcomeDenied))
+	n.Record(testDecision("default", handlers.OutcomeWarned))
+	n.Record(testDecision("default", handlers.OutcomeAllowed))
+	n.Close()
+
+	if len(payments.messages) != 1 || payments.messages[0].Channel != "#payments" {
+		t.Errorf("Expecting one message to #payments, got %+v", payments.messages)
+	}
+	if len(platform.messages) != 1 {
+		t.Fatalf("Expecting one message to platform, got %+v", platform.messages)
+	}
+	text := platform.messages[0].Text
+	if !strings.Contains(text, "Denied CREATE of Service default/test-service") || !strings.Contains(text, "is public") {
+		t.Errorf("Unexpected message text %s", text)
+	}
+}
+
+func TestDedupAndRateLimit(t *testing.T) {
+	r := &slackReceiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	n, err := NewNotifier(Options{
+		Receivers:   []ReceiverOptions{{Name: "platform", Slack: &SlackOptions{URL: server.URL}}},
+		Routes:      []Route{{Receivers: []string{"platform"}}},
+		DedupWindow: time.Hour,
+		RateLimit:   RateLimit{Messages: 2, Interval: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2018, 4, 21, 3, 19, 46, 0, time.UTC)
+	n.now = func() time.Time { return now }
+
+	// retries of the same request are only notified once
+	for i := 0; i < 5; i++ {
+		d := testDecision("default", handlers.OutcomeDenied)
+		d.UID = "retry"
+		n.Record(d)
+	}
+	if r := n.receivers["platform"]; r.sent != 1 {
+		t.Errorf("Expecting retries to be deduplicated, sent %d", r.sent)
+	}
+
+	// different objects are limited to 2 a minute
+	for i := 0; i < 5; i++ {
+		d := testDecision("default", handlers.OutcomeDenied)
+		d.Name = fmt.Sprintf("service-%d", i)
+		n.Record(d)
+	}
+	if r := n.receivers["platform"]; r.sent != 2 {
+		t.Errorf("Expecting to be rate limited to 2 messages, sent %d", r.sent)
+	}
+
+	// after the dedup window, the same rejection is notified again
+	now = now.Add(2 * time.Hour)
+	n.Record(testDecision("default", handlers.OutcomeDenied))
+	n.Close()
+
+	if len(r.messages) != 3 {
+		t.Errorf("Expecting 3 messages, got %d", len(r.messages))
+	}
+}
+
+// a sender that blocks until released
+type blockingSender struct {
+	release chan struct{}
+}
+
+func (s *blockingSender) send(subject, text string) error {
+	<-s.release
+	return nil
+}
+
+func TestDroppedNotDeduplicated(t *testing.T) {
+	n, err := NewNotifier(Options{
+		Receivers: []ReceiverOptions{{Name: "platform", Slack: &SlackOptions{URL: "http://127.0.0.1:1"}}},
+		Routes:    []Route{{Receivers: []string{"platform"}}},
+		RateLimit: RateLimit{Messages: 1000, Interval: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocking := &blockingSender{release: make(chan struct{})}
+	r := n.receivers["platform"]
+	r.sender = blocking
+
+	// fill the queue, while the first notification is being sent
+	for i := 0; len(r.queue) < queueSize; i++ {
+		d := testDecision("default", handlers.OutcomeDenied)
+		d.Name = fmt.Sprintf("service-%d", i)
+		n.Record(d)
+	}
+	dropped := testDecision("default", handlers.OutcomeDenied)
+	dropped.Name = "dropped"
+	n.Record(dropped)
+	sent := r.sent
+
+	close(blocking.release)
+	for len(r.queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	n.Record(dropped)
+	if r.sent != sent+1 {
+		t.Error("Expecting a dropped notification not to suppress its repeats")
+	}
+
+	n.Close()
+	n.Record(dropped)
+	n.Close()
+}
+
+func TestEmail(t *testing.T) {
+	var sent []string
+	sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent = append(sent, fmt.Sprintf("%s %s %s\n%s", addr, from, strings.Join(to, ","), msg))
+		return nil
+	}
+	defer func() { sendMail = smtp.SendMail }()
+
+	n, err := NewNotifier(Options{
+		Receivers: []ReceiverOptions{{Name: "payments", Email: &EmailOptions{
+			SmartHost: "smtp.example.com:587",
+			From:      "Admission Webhooks <webhooks@example.com>",
+			To:        []string{"payments@example.com"},
+		}}},
+		Routes: []Route{{Receivers: []string{"payments"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Record(testDecision("payments", handlers.OutcomeDenied))
+	n.Close()
+
+	if len(sent) != 1 {
+		t.Fatalf("Expecting one email, got %d", len(sent))
+	}
+	if !strings.HasPrefix(sent[0], "smtp.example.com:587 webhooks@example.com payments@example.com\n") {
+		t.Errorf("Unexpected envelope %s", sent[0])
+	}
+	if !strings.Contains(sent[0], "Subject: Denied CREATE of Service payments/test-service\r\n") {
+		t.Errorf("Expecting a subject, got %s", sent[0])
+	}
+}
+
+func TestValidate(t *testing.T) {
+	options := Options{
+		Receivers: []ReceiverOptions{
+			{Name: "none"},
+			{Name: "bad-email", Email: &EmailOptions{SmartHost: "smtp.example.com", From: "webhooks@example.com"}},
+		},
+		Routes: []Route{
+			{Receivers: []string{"unknown"}, Namespaces: []string{"Not_A_Namespace"}, Severities: []handlers.DecisionOutcome{handlers.OutcomeAllowed}},
+		},
+	}
+	err := options.Validate()
+	if err == nil {
+		t.Fatal("Expecting the options to be invalid")
+	}
+
+	for _, expected := range []string{
+		"receivers[none]: one of slack or email is required",
+		"receivers[bad-email]: smarthost must be host:port",
+		"routes[0]: unknown receiver 'unknown'",
+		"routes[0]: namespace 'Not_A_Namespace' is invalid",
+		"routes[0]: severity must be one of",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expecting error '%s' in %v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*    Copyright 2018 Ben Burry
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Post to a Slack-compatible incoming webhook
+// (https://api.slack.com/messaging/webhooks), as also accepted by Mattermost
+// and Rocket.Chat.
+
+type SlackOptions struct {
+	URL string `yaml:"url"`
+	// Override the webhook's default channel and username, where allowed
+	Channel  string `yaml:"channel"`
+	Username string `yaml:"username"`
+}
+
+func (o *SlackOptions) validate() error {
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		return fmt.Errorf("invalid slack url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("slack url must be http or https")
+	}
+	return nil
+}
+
+type slackSender struct {
+	options SlackOptions
+	client  *http.Client
+}
+
+type slackMessage struct {
+	Text     string `json:"text"`
+	Channel  string `json:"channel,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+func newSlackSender(options SlackOptions) *slackSender {
+	return &slackSender{options: options, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *slackSender) send(subject, text string) error {
+	body, err := json.Marshal(slackMessage{
+		Text:     fmt.Sprintf("*%s*\n%s", subject, text),
+		Channel:  s.options.Channel,
+		Username: s.options.Username,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.options.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}